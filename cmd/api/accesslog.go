@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// accessLogWriter struct serializes the writes of the Apache combined format access log lines.
+type accessLogWriter struct {
+	out io.Writer
+	mu  sync.Mutex
+}
+
+func (aw *accessLogWriter) writeLine(line string) {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+
+	io.WriteString(aw.out, line)
+}
+
+// shouldLogAccess decides whether a request is written to the access log. Server errors and
+// requests slower than the threshold are always logged, client errors too since they are
+// usually worth investigating, and successful responses are sampled at the configured rate.
+func (app *application) shouldLogAccess(status int, duration time.Duration) bool {
+	cfg := app.currentConfig().accessLog
+
+	switch {
+	case status >= http.StatusInternalServerError:
+		return true
+	case cfg.slowThreshold > 0 && duration >= cfg.slowThreshold:
+		return true
+	case status >= http.StatusBadRequest:
+		return true
+	default:
+		return rand.Float64() < cfg.sampleRate
+	}
+}
+
+// logAccess middleware writes a line per request to the access log, either as a jsonlog entry
+// or in the Apache combined log format. The access log can be enabled and disabled by a config
+// reload, so the middleware is always installed and checks the current config.
+func (app *application) logAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.currentConfig().accessLog.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		mw := newMetricsResponseWriter(w)
+
+		next.ServeHTTP(mw, r)
+
+		duration := time.Since(start)
+		if !app.shouldLogAccess(mw.statusCode, duration) {
+			return
+		}
+
+		clientIP := app.contextGetClientIP(r)
+
+		userID := app.contextGetRequestUserID(r)
+
+		if app.currentConfig().accessLog.format == "combined" {
+			app.writeCombinedLogLine(r, mw, start, clientIP, userID)
+			return
+		}
+
+		properties := map[string]interface{}{
+			"request_method": r.Method,
+			"request_route":  app.contextGetRoutePattern(r),
+			"request_url":    r.URL.RequestURI(),
+			"status":         mw.statusCode,
+			"bytes":          mw.bytes,
+			"duration":       duration,
+			"client_ip":      clientIP,
+		}
+
+		if userID > 0 {
+			properties["user_id"] = userID
+		}
+
+		app.logger.PrintInfoCtx(r.Context(), "request completed", properties)
+	})
+}
+
+// writeCombinedLogLine writes the access log line in the Apache combined log format:
+// host ident authuser [date] "request line" status bytes "referer" "user-agent"
+func (app *application) writeCombinedLogLine(r *http.Request, mw *metricsResponseWriter, start time.Time, clientIP string, userID int64) {
+	user := "-"
+	if userID > 0 {
+		user = strconv.FormatInt(userID, 10)
+	}
+
+	bytes := "-"
+	if mw.bytes > 0 {
+		bytes = strconv.Itoa(mw.bytes)
+	}
+
+	referer := r.Referer()
+	if referer == "" {
+		referer = "-"
+	}
+
+	userAgent := r.UserAgent()
+	if userAgent == "" {
+		userAgent = "-"
+	}
+
+	line := fmt.Sprintf("%s - %s [%s] %q %d %s %q %q\n",
+		clientIP,
+		user,
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		fmt.Sprintf("%s %s %s", r.Method, r.URL.RequestURI(), r.Proto),
+		mw.statusCode,
+		bytes,
+		referer,
+		userAgent,
+	)
+
+	app.accessLog.writeLine(line)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"expvar"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/http/pprof"
+)
+
+// adminRoutes method returns the handler of the admin server, which is only reachable on
+// -admin-addr: the profiling, metrics and operational endpoints must not be exposed publicly.
+func (app *application) adminRoutes() http.Handler {
+	router := httprouter.New()
+
+	router.NotFound = http.HandlerFunc(app.notFoundResponse)
+	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+
+	router.HandlerFunc(http.MethodGet, "/debug/pprof/*item", app.pprofHandler)
+	router.HandlerFunc(http.MethodPost, "/debug/pprof/*item", app.pprofHandler)
+
+	// Expose the expvar variables, including the movie cache statistics, and the metrics in
+	// the Prometheus text format.
+	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+	router.Handler(http.MethodGet, "/debug/metrics", app.metrics.registry.Handler())
+
+	router.HandlerFunc(http.MethodGet, "/debug/config", app.showConfigHandler)
+
+	// Read and change the minimum log level at runtime.
+	router.HandlerFunc(http.MethodGet, "/debug/log-level", app.showLogLevelHandler)
+	router.HandlerFunc(http.MethodPut, "/debug/log-level", app.updateLogLevelHandler)
+
+	router.HandlerFunc(http.MethodGet, "/debug/limiter/keys", app.listLimiterKeysHandler)
+
+	// List the accounts and client IP addresses with failed logins, and unlock them.
+	router.HandlerFunc(http.MethodGet, "/debug/login-attempts", app.listLoginAttemptsHandler)
+	router.HandlerFunc(http.MethodDelete, "/debug/login-attempts/:kind/:key", app.deleteLoginAttemptsHandler)
+
+	return app.recoverPanic(router)
+}
+
+// pprofHandler method dispatches to the net/http/pprof handlers. httprouter doesn't allow the
+// static routes next to the catch-all route, so the dispatch is done here. pprof.Index also serves
+// the named profiles, e.g. /debug/pprof/heap or /debug/pprof/goroutine.
+func (app *application) pprofHandler(w http.ResponseWriter, r *http.Request) {
+	switch httprouter.ParamsFromContext(r.Context()).ByName("item") {
+	case "/cmdline":
+		pprof.Cmdline(w, r)
+	case "/profile":
+		pprof.Profile(w, r)
+	case "/symbol":
+		pprof.Symbol(w, r)
+	case "/trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Index(w, r)
+	}
+}
+
+// showConfigHandler method returns the running configuration, with the secrets redacted.
+func (app *application) showConfigHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"config": redactedConfig(app.currentConfig())}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listLimiterKeysHandler method returns the keys (users and client IP addresses, by policy)
+// currently tracked by the rate limiter.
+func (app *application) listLimiterKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := app.limiter.Snapshot(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"keys": keys, "total": len(keys)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"github.com/luca0x333/go-greenlight/internal/data"
+	"github.com/luca0x333/go-greenlight/internal/validator"
+	"net/http"
+	"time"
+)
+
+// The handlers below manage the user accounts for the administrators, with the users:admin
+// permission. Every change is made and recorded by recordAdminAction().
+
+// listUsersHandler method returns a page of the users, filtered by name or email address (q) and
+// by activation (activated=true|false), sorted by id, created_at, name or email.
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Search    string
+		Activated *bool
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Search = app.readString(qs, "q", "")
+	input.Activated = app.readBool(qs, "activated", v)
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "created_at", "name", "email", "-id", "-created_at", "-name", "-email"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(r.Context(), input.Search, input.Activated, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showUserHandler method returns the user and their permissions.
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateUserHandler method activates or deactivates the user. The deactivated users are logged
+// out: their tokens, API keys and pending email change are deleted. The administrators can't
+// deactivate their own account.
+func (app *application) updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Activated *bool `json:"activated"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.Activated != nil, "activated", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if user.ID == app.contextGetUser(r).ID && !*input.Activated {
+		app.adminSelfActionResponse(w, r)
+		return
+	}
+
+	if user.Activated != *input.Activated {
+		user.Activated = *input.Activated
+
+		action := data.AdminActionDeactivate
+		if user.Activated {
+			action = data.AdminActionActivate
+		}
+
+		err = app.recordAdminAction(r, user.ID, action, nil, func(tx data.Models) error {
+			err := tx.Users.Update(r.Context(), user)
+			if err != nil {
+				return err
+			}
+
+			if !user.Activated {
+				return revokeUserAccess(r.Context(), tx, user.ID)
+			}
+
+			return nil
+		})
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// resetUserPasswordHandler method forces the user to choose a new password: the password is
+// replaced by a random one, the user is logged out and gets a token by email to set a new
+// password with updateUserPasswordHandler().
+func (app *application) resetUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := user.Password.SetRandom()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var token *data.Token
+
+	err = app.recordAdminAction(r, user.ID, data.AdminActionResetPassword, nil, func(tx data.Models) error {
+		err := tx.Users.Update(r.Context(), user)
+		if err != nil {
+			return err
+		}
+
+		err = deleteUserTokens(r.Context(), tx, user.ID)
+		if err != nil {
+			return err
+		}
+
+		token, err = tx.Tokens.New(r.Context(), user.ID, 24*time.Hour, data.ScopePasswordReset)
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.background(func() {
+		err := app.mailer.Send(r.Context(), user.Email, "password_reset.tmpl", map[string]interface{}{
+			"Name":  user.Name,
+			"Token": token.Plaintext,
+		})
+		if err != nil {
+			app.logger.PrintErrorCtx(r.Context(), err, nil)
+		}
+	})
+
+	message := "the password has been reset, an email will be sent to the user containing the instructions to choose a new one"
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": message}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// grantUserPermissionHandler method grants the permission to the user,
+// e.g. PUT /v1/admin/users/1/permissions/movies:write.
+func (app *application) grantUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	code := httprouter.ParamsFromContext(r.Context()).ByName("code")
+
+	permissions, err := app.models.Permissions.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(permissions.Include(code), "code", "must be an existing permission"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.recordAdminAction(r, user.ID, data.AdminActionGrantPermission, map[string]interface{}{"permission": code}, func(tx data.Models) error {
+		return tx.Permissions.AddForUser(r.Context(), user.ID, code)
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeUserPermissions(w, r, user)
+}
+
+// revokeUserPermissionHandler method revokes the permission of the user. The administrators
+// can't revoke their own users:admin permission, so that there is always one left. A 404 Not
+// Found response is sent if the user doesn't have the permission.
+func (app *application) revokeUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	code := httprouter.ParamsFromContext(r.Context()).ByName("code")
+
+	permissions, err := app.models.Permissions.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(permissions.Include(code), "code", "must be an existing permission"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if user.ID == app.contextGetUser(r).ID && code == data.PermissionUsersAdmin {
+		app.adminSelfActionResponse(w, r)
+		return
+	}
+
+	// Nothing is recorded if the user didn't have the permission.
+	err = app.recordAdminAction(r, user.ID, data.AdminActionRevokePermission, map[string]interface{}{"permission": code}, func(tx data.Models) error {
+		return tx.Permissions.RemoveForUser(r.Context(), user.ID, code)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeUserPermissions(w, r, user)
+}
+
+// deleteUserHandler method deletes the user, with their tokens, API keys etc. The
+// administrators can't delete their own account.
+func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	if id == app.contextGetUser(r).ID {
+		app.adminSelfActionResponse(w, r)
+		return
+	}
+
+	err = app.recordAdminAction(r, id, data.AdminActionDelete, nil, func(tx data.Models) error {
+		return tx.Users.Delete(r.Context(), id)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listAdminActionsHandler method returns a page of the recorded actions of the administrators,
+// the most recent first, optionally on a single user (user_id).
+func (app *application) listAdminActionsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		UserID int
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.UserID = app.readInt(qs, "user_id", 0, v)
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = "-id"
+	input.Filters.SortSafelist = []string{"-id"}
+
+	v.Check(input.UserID >= 0, "user_id", "must not be negative")
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	actions, metadata, err := app.models.AdminActions.GetAll(r.Context(), int64(input.UserID), input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"admin_actions": actions, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readUserParam method returns the user with the id URL parameter. It sends the error response
+// and returns false if there is no such user.
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := app.models.Users.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
+
+// writeUserPermissions method sends the permissions of the user after a change.
+func (app *application) writeUserPermissions(w http.ResponseWriter, r *http.Request, user *data.User) {
+	permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// recordAdminAction method makes the change of the authenticated administrator on the user and
+// records the action in the admin_actions table in the same transaction, so that an action is
+// recorded if and only if the change is made. The action is logged once committed.
+func (app *application) recordAdminAction(r *http.Request, userID int64, action string, details map[string]interface{}, change func(tx data.Models) error) error {
+	actorID := app.contextGetUser(r).ID
+
+	err := app.models.Transaction(r.Context(), func(tx data.Models) error {
+		err := change(tx)
+		if err != nil {
+			return err
+		}
+
+		return tx.AdminActions.Insert(r.Context(), &data.AdminAction{
+			ActorID: &actorID,
+			UserID:  userID,
+			Action:  action,
+			Details: details,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	properties := map[string]interface{}{
+		"actor_id": actorID,
+		"user_id":  userID,
+		"action":   action,
+	}
+
+	for key, value := range details {
+		properties[key] = value
+	}
+
+	app.logger.PrintInfoCtx(r.Context(), "admin action", properties)
+
+	return nil
+}
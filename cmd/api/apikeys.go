@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"github.com/luca0x333/go-greenlight/internal/data"
+	"github.com/luca0x333/go-greenlight/internal/validator"
+	"net/http"
+	"time"
+)
+
+// listAPIKeysHandler method returns the API keys of the authenticated user, without the keys
+// themselves which are only sent on creation.
+func (app *application) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := app.models.APIKeys.GetAllForUser(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"api_keys": keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createAPIKeyHandler method creates an API key for the authenticated user, with a subset of
+// the user's permissions and an optional expiry. The key is only sent in this response.
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string     `json:"name"`
+		Permissions []string   `json:"permissions"`
+		Expiry      *time.Time `json:"expiry"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	key, err := data.GenerateAPIKey(user.ID, input.Name, input.Permissions, input.Expiry)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	userPermissions, err := app.permissionsFor(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateAPIKey(v, key)
+	v.Check(len(key.Permissions.Intersect(userPermissions)) == len(key.Permissions), "permissions", "must be a subset of your permissions")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.APIKeys.Insert(r.Context(), key)
+	if err != nil {
+		app.constraintErrorResponse(w, r, v, err)
+		return
+	}
+
+	app.logger.PrintInfoCtx(r.Context(), "api key created", map[string]interface{}{
+		"user_id":    user.ID,
+		"api_key_id": key.ID,
+		"prefix":     key.Prefix,
+	})
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"api_key": key}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteAPIKeyHandler method revokes an API key of the authenticated user.
+func (app *application) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.APIKeys.Delete(r.Context(), id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.logger.PrintInfoCtx(r.Context(), "api key revoked", map[string]interface{}{
+		"user_id":    user.ID,
+		"api_key_id": id,
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "api key successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
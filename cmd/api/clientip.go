@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// resolveClientIP middleware stores the IP address of the client in the request context, for the
+// rate limiter, the access log and the log entries of the request. When the peer is one of the
+// -trusted-proxies, the address is taken from the forwarding headers: Forwarded (RFC 7239), then
+// X-Forwarded-For, then X-Real-IP. The headers of the other peers are ignored, since any client
+// can set them.
+func (app *application) resolveClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r, app.currentConfig().trustedProxies)
+		r = app.contextSetClientIP(r, ip)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP function returns the IP address of the client of the request, see resolveClientIP.
+func clientIP(r *http.Request, trustedProxies []string) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+
+	if len(trustedProxies) == 0 || !ipInCIDRs(net.ParseIP(peer), trustedProxies) {
+		return peer
+	}
+
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		return lastUntrustedHop(forwardedFor(values), peer, trustedProxies)
+	}
+
+	if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		return lastUntrustedHop(splitList(values), peer, trustedProxies)
+	}
+
+	if ip := parseNode(r.Header.Get("X-Real-IP")); ip != nil {
+		return ip.String()
+	}
+
+	return peer
+}
+
+// lastUntrustedHop function walks the chain of the forwarding headers from the right, where each
+// proxy appends the address of its own peer, and returns the first address which isn't a trusted
+// proxy: the addresses on its left were set by the client and can't be trusted. The walk stops
+// at an invalid or obfuscated address and returns the last valid one.
+func lastUntrustedHop(hops []string, peer string, trustedProxies []string) string {
+	client := peer
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseNode(hops[i])
+		if ip == nil {
+			break
+		}
+
+		client = ip.String()
+
+		if !ipInCIDRs(ip, trustedProxies) {
+			break
+		}
+	}
+
+	return client
+}
+
+// forwardedFor function returns the for= parameters of the Forwarded header values, in order,
+// e.g. `for=192.0.2.60;proto=https, for="[2001:db8:cafe::17]:4711"`. An element without a for=
+// parameter is returned as an empty, invalid, hop.
+func forwardedFor(values []string) []string {
+	var hops []string
+
+	for _, element := range splitList(values) {
+		hop := ""
+
+		for _, pair := range strings.Split(element, ";") {
+			i := strings.Index(pair, "=")
+			if i < 0 {
+				continue
+			}
+
+			if strings.EqualFold(strings.TrimSpace(pair[:i]), "for") {
+				hop = strings.Trim(strings.TrimSpace(pair[i+1:]), `"`)
+				break
+			}
+		}
+
+		hops = append(hops, hop)
+	}
+
+	return hops
+}
+
+// splitList function splits comma separated header values into their trimmed elements.
+func splitList(values []string) []string {
+	var elements []string
+
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			elements = append(elements, strings.TrimSpace(element))
+		}
+	}
+
+	return elements
+}
+
+// parseNode function parses the address of a forwarding header, with an optional port:
+// 192.0.2.60, 192.0.2.60:4711, 2001:db8::17 or [2001:db8::17]:4711. It returns nil for invalid
+// addresses and for the "unknown" and obfuscated identifiers of RFC 7239.
+func parseNode(node string) net.IP {
+	node = strings.TrimSpace(node)
+
+	if strings.HasPrefix(node, "[") {
+		end := strings.Index(node, "]")
+		if end < 0 {
+			return nil
+		}
+		node = node[1:end]
+	} else if strings.Count(node, ":") == 1 {
+		node = node[:strings.Index(node, ":")]
+	}
+
+	return net.ParseIP(node)
+}
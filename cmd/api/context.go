@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"github.com/luca0x333/go-greenlight/internal/data"
+	"github.com/luca0x333/go-greenlight/internal/jsonlog"
+	"net/http"
+)
+
+// contextKey custom type is used for the keys of the values we store in the request context,
+// to avoid collisions with keys set by third-party packages.
+type contextKey string
+
+const (
+	requestInfoContextKey = contextKey("requestInfo")
+	requestIDContextKey   = contextKey("requestID")
+	clientIPContextKey    = contextKey("clientIP")
+	serviceContextKey     = contextKey("service")
+	userContextKey        = contextKey("user")
+	apiKeyContextKey      = contextKey("apiKey")
+)
+
+// requestInfo struct holds what the inner layers learn about a request and the outer middleware
+// need once it has been served: the httprouter pattern (e.g. /v1/movies/:id) of the matched route
+// and the ID of the authenticated user. The inner layers work on their own copy of the request,
+// so the outer middleware store a pointer in the context which the inner layers fill in.
+type requestInfo struct {
+	pattern string
+	userID  int64
+}
+
+// contextSetRequestInfo returns a copy of the request with an empty requestInfo in its context.
+func (app *application) contextSetRequestInfo(r *http.Request) *http.Request {
+	ctx := context.WithValue(r.Context(), requestInfoContextKey, &requestInfo{})
+	return r.WithContext(ctx)
+}
+
+// contextSetRoutePattern records the pattern of the matched route in the request context.
+func (app *application) contextSetRoutePattern(r *http.Request, pattern string) {
+	info, ok := r.Context().Value(requestInfoContextKey).(*requestInfo)
+	if ok {
+		info.pattern = pattern
+	}
+}
+
+// contextGetRoutePattern returns the pattern of the matched route, or "unmatched" if no route
+// matched the request. The raw URL is never returned to keep the metric labels bounded.
+func (app *application) contextGetRoutePattern(r *http.Request) string {
+	info, ok := r.Context().Value(requestInfoContextKey).(*requestInfo)
+	if !ok || info.pattern == "" {
+		return "unmatched"
+	}
+
+	return info.pattern
+}
+
+// contextSetRequestUserID records the ID of the authenticated user in the request context, so
+// that it appears in the access log.
+func (app *application) contextSetRequestUserID(r *http.Request, userID int64) {
+	info, ok := r.Context().Value(requestInfoContextKey).(*requestInfo)
+	if ok {
+		info.userID = userID
+	}
+}
+
+// contextGetRequestUserID returns the ID of the authenticated user, or 0 for anonymous requests.
+func (app *application) contextGetRequestUserID(r *http.Request) int64 {
+	info, ok := r.Context().Value(requestInfoContextKey).(*requestInfo)
+	if !ok {
+		return 0
+	}
+
+	return info.userID
+}
+
+// contextSetRequestID returns a copy of the request with the request ID added to its context,
+// both for contextGetRequestID() and as a field of the entries logged with the Ctx methods.
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	ctx = jsonlog.ContextWithFields(ctx, map[string]interface{}{"request_id": id})
+	return r.WithContext(ctx)
+}
+
+// contextGetRequestID returns the ID of the request, or an empty string if the request didn't
+// go through the requestID middleware.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// contextSetClientIP returns a copy of the request with the IP address of the client added to its
+// context, both for contextGetClientIP() and as a field of the entries logged with the Ctx methods.
+func (app *application) contextSetClientIP(r *http.Request, ip string) *http.Request {
+	ctx := context.WithValue(r.Context(), clientIPContextKey, ip)
+	ctx = jsonlog.ContextWithFields(ctx, map[string]interface{}{"client_ip": ip})
+	return r.WithContext(ctx)
+}
+
+// contextGetClientIP returns the IP address of the client, resolved by the resolveClientIP
+// middleware. The requests which didn't go through it fall back to the address of the peer.
+func (app *application) contextGetClientIP(r *http.Request) string {
+	ip, ok := r.Context().Value(clientIPContextKey).(string)
+	if !ok {
+		return clientIP(r, nil)
+	}
+
+	return ip
+}
+
+// contextSetServiceIdentity returns a copy of the request with the identity of the calling
+// service added to its context, and as a field of the entries logged with the Ctx methods.
+func (app *application) contextSetServiceIdentity(r *http.Request, identity string) *http.Request {
+	ctx := context.WithValue(r.Context(), serviceContextKey, identity)
+	ctx = jsonlog.ContextWithFields(ctx, map[string]interface{}{"service": identity})
+	return r.WithContext(ctx)
+}
+
+// contextGetServiceIdentity returns the identity of the calling service, or an empty string if
+// the client didn't authenticate with a certificate.
+func (app *application) contextGetServiceIdentity(r *http.Request) string {
+	identity, _ := r.Context().Value(serviceContextKey).(string)
+	return identity
+}
+
+// contextSetUser returns a copy of the request with the user added to its context. The ID of an
+// authenticated user is also recorded for the access log.
+func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	if !user.IsAnonymous() {
+		app.contextSetRequestUserID(r, user.ID)
+	}
+
+	ctx := context.WithValue(r.Context(), userContextKey, user)
+	return r.WithContext(ctx)
+}
+
+// contextSetAPIKey returns a copy of the request with the API key which authenticated it added
+// to its context, and its ID as a field of the entries logged with the Ctx methods.
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	ctx = jsonlog.ContextWithFields(ctx, map[string]interface{}{"api_key_id": key.ID})
+	return r.WithContext(ctx)
+}
+
+// contextGetAPIKey returns the API key which authenticated the request, or nil if the request
+// is anonymous or authenticated with a token.
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
+
+// contextGetUser returns the user of the request. It is only called when we logically expect
+// a user in the context (every request goes through the authenticate middleware), so a missing
+// value is an unexpected error and we panic.
+func (app *application) contextGetUser(r *http.Request) *data.User {
+	user, ok := r.Context().Value(userContextKey).(*data.User)
+	if !ok {
+		panic("missing user value in request context")
+	}
+
+	return user
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// corsAllowedHeaders are the request headers the trusted origins may send, and
+// corsExposedHeaders the response headers their scripts may read.
+const (
+	corsAllowedHeaders = "Authorization, Content-Type, X-Request-ID"
+	corsExposedHeaders = "Location, Retry-After, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, WWW-Authenticate, X-Request-ID"
+)
+
+// enableCORS middleware lets the browser clients of the -cors-trusted-origins (e.g. the admin UI)
+// read the responses of the API. The requests of the other origins are served as usual, without
+// the CORS headers, so the browsers don't expose the responses to their scripts. The preflight
+// requests are answered by preflightHandler(), once the router has found the methods of the URL.
+func (app *application) enableCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The response depends on the Origin header even when it isn't trusted: the caches
+		// must not serve the response of one origin to another.
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		cfg := app.currentConfig().cors
+
+		if origin != "" && originTrusted(origin, cfg.trustedOrigins) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if cfg.allowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if !isPreflight(r) {
+				w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isPreflight function returns true if the request is a CORS preflight request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// preflightHandler method answers the OPTIONS requests of the routes. httprouter sets the Allow
+// header to the methods registered for the URL before calling it, which are the methods allowed
+// to the trusted origins. The plain OPTIONS requests only get the Allow header.
+func (app *application) preflightHandler(w http.ResponseWriter, r *http.Request) {
+	if !isPreflight(r) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		cfg := app.currentConfig().cors
+
+		w.Header().Set("Access-Control-Allow-Methods", w.Header().Get("Allow"))
+		w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.maxAge.Seconds())))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// originTrusted function returns true if the origin matches one of the trusted origins. The
+// scheme, host and port must be equal, and a trusted origin with a host starting with "*."
+// matches all the subdomains of the rest of the host, at any depth, but not the domain itself.
+func originTrusted(origin string, trustedOrigins []string) bool {
+	o, ok := parseOrigin(origin)
+	if !ok {
+		return false
+	}
+
+	for _, trusted := range trustedOrigins {
+		t, ok := parseOrigin(trusted)
+		if !ok || t.Scheme != o.Scheme || t.Port() != o.Port() {
+			continue
+		}
+
+		if strings.HasPrefix(t.Hostname(), "*.") {
+			if strings.HasSuffix(o.Hostname(), t.Hostname()[1:]) {
+				return true
+			}
+			continue
+		}
+
+		if t.Hostname() == o.Hostname() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseOrigin function parses an origin, scheme://host[:port] without a path, lowercasing the
+// scheme and the host. The "null" origin of the sandboxed documents is rejected.
+func parseOrigin(origin string) (*url.URL, bool) {
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Scheme == "" || u.Host == "" || u.User != nil {
+		return nil, false
+	}
+
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return nil, false
+	}
+
+	return u, true
+}
+
+// validOrigins returns true if all the values are valid origins, see originTrusted().
+func validOrigins(origins []string) bool {
+	for _, origin := range origins {
+		u, ok := parseOrigin(origin)
+		if !ok {
+			return false
+		}
+
+		// A wildcard is only allowed as the first label of the host.
+		if strings.Contains(strings.TrimPrefix(u.Hostname(), "*."), "*") {
+			return false
+		}
+	}
+
+	return true
+}
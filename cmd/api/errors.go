@@ -1,22 +1,33 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"github.com/luca0x333/go-greenlight/internal/data"
+	"github.com/luca0x333/go-greenlight/internal/validator"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 // logError method is a generic helper for logging an error message.
+// The fields stored in the request context, like the request ID, are added to the entry.
 func (app *application) logError(r *http.Request, err error) {
-	app.logger.PrintError(err, map[string]string{
+	app.logger.PrintErrorCtx(r.Context(), err, map[string]interface{}{
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
 	})
 }
 
 // errorResponse method is a generic helper for sending JSON formatted error messages.
+// The request ID is included so that the client can quote it when reporting a problem.
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
 	env := envelope{"error": message}
 
+	if id := app.contextGetRequestID(r); id != "" {
+		env["request_id"] = id
+	}
+
 	err := app.writeJSON(w, status, env, nil)
 	if err != nil {
 		app.logError(r, err)
@@ -63,8 +74,126 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
+// totpConflictResponse method will be used to send a 409 StatusConflict code to the client when
+// the request doesn't apply to the current state of the two-factor authentication of the user.
+func (app *application) totpConflictResponse(w http.ResponseWriter, r *http.Request, message string) {
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+// totpUnavailableResponse method will be used to send a 501 StatusNotImplemented code to the
+// client when two-factor authentication isn't configured on the server (-totp-encryption-key).
+func (app *application) totpUnavailableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "two-factor authentication isn't available on this server"
+	app.errorResponse(w, r, http.StatusNotImplemented, message)
+}
+
+// oidcUnavailableResponse method will be used to send a 501 StatusNotImplemented code to the
+// client when the OIDC login isn't configured on the server (-oidc-issuer).
+func (app *application) oidcUnavailableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "OIDC login isn't available on this server"
+	app.errorResponse(w, r, http.StatusNotImplemented, message)
+}
+
+// oidcLoginFailedResponse method will be used to send a 401 StatusUnauthorized code to the
+// client when an OIDC login can't be completed: unknown or expired state, error of the provider,
+// invalid ID token or no matching user.
+func (app *application) oidcLoginFailedResponse(w http.ResponseWriter, r *http.Request, message string) {
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
 // rateLimitExceededResponse method will be used to send a 429 StatusTooManyRequests code to the client.
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
+
+// invalidCredentialsResponse method will be used to send a 401 StatusUnauthorized code to the
+// client when the email address or password are wrong.
+func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid authentication credentials"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// invalidAPIKeyResponse method will be used to send a 401 StatusUnauthorized code to the client
+// when the API key is malformed, unknown, revoked or expired.
+func (app *application) invalidAPIKeyResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "ApiKey")
+
+	message := "invalid API key"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// notPermittedResponse method will be used to send a 403 StatusForbidden code to the client
+// when the authenticated user (or API key) doesn't have the permission required by the route.
+func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account doesn't have the necessary permissions to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// inactiveAccountResponse method will be used to send a 403 StatusForbidden code to the client
+// when the user has been deactivated by an administrator.
+func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been deactivated"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// adminSelfActionResponse method will be used to send a 403 StatusForbidden code to the client
+// when administrators try to delete or deactivate their own account, or revoke their own
+// users:admin permission.
+func (app *application) adminSelfActionResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you can't delete or deactivate your own account, or revoke your own users:admin permission"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// userTokenRequiredResponse method will be used to send a 403 StatusForbidden code to the client
+// when a request authenticated with an API key is made to a route requiring a user token.
+func (app *application) userTokenRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can't be accessed with an API key"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// authenticationRequiredResponse method will be used to send a 401 StatusUnauthorized code to
+// the client when an anonymous request is made to a route requiring an authenticated user.
+func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+
+	message := "you must be authenticated to access this resource"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// tooManyLoginAttemptsResponse method will be used to send a 429 Too Many Requests code to the
+// client when the account or the IP address of a login is delayed or locked out after too many
+// failed logins. Retry-After tells the client when to retry.
+func (app *application) tooManyLoginAttemptsResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+
+	message := "too many failed login attempts, try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// invalidAuthenticationTokenResponse method will be used to send a 401 StatusUnauthorized code to
+// the client when the authentication token is missing, malformed or expired.
+func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+
+	message := "invalid or missing authentication token"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// constraintErrorResponse method translates an error returned by one of the models write methods.
+// Constraint violations which can be attributed to an input field are added to the validator and
+// sent as a 422 response, serialization failures are sent as a 409 edit conflict and any other
+// error is treated as a server error.
+func (app *application) constraintErrorResponse(w http.ResponseWriter, r *http.Request, v *validator.Validator, err error) {
+	var constraintErr *data.ConstraintError
+
+	switch {
+	case errors.Is(err, data.ErrSerializationFailure):
+		app.editConflictResponse(w, r)
+	case errors.As(err, &constraintErr) && constraintErr.Field != "":
+		v.AddError(constraintErr.Field, constraintErr.Message)
+		app.failedValidationResponse(w, r, v.Errors)
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,14 +1,25 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/luca0x333/go-greenlight/internal/data"
+	"github.com/luca0x333/go-greenlight/internal/health"
+	"github.com/luca0x333/go-greenlight/internal/mailer"
 	"net/http"
+	"sync"
+	"time"
 )
 
+// healthCheckHandler reports that the application is running, along with its environment and
+// version. It is also served as the liveness probe, which doesn't check the dependencies so that
+// an orchestrator doesn't restart the application when the database is down.
 func (app *application) healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	env := envelope{
 		"status": "available",
 		"system_info": map[string]string{
-			"environment": app.config.env,
+			"environment": app.currentConfig().env,
 			"version":     version,
 		},
 	}
@@ -18,3 +29,146 @@ func (app *application) healthCheckHandler(w http.ResponseWriter, r *http.Reques
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// readinessHandler runs the dependency checks and reports the status and latency of each.
+// It responds with 503 Service Unavailable when a critical check fails, or once the graceful
+// shutdown has started, so that no new traffic is routed to the application.
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	report := app.health.Check()
+
+	checks := make(map[string]interface{}, len(report.Results))
+	for name, result := range report.Results {
+		check := envelope{
+			"status":   result.Status,
+			"critical": result.Critical,
+			"latency":  result.Latency.String(),
+		}
+
+		if result.Error != "" {
+			check["error"] = result.Error
+		}
+
+		checks[name] = check
+	}
+
+	status, code := "available", http.StatusOK
+	switch {
+	case !report.Healthy:
+		status, code = "unavailable", http.StatusServiceUnavailable
+	case report.Degraded:
+		status = "degraded"
+	}
+
+	env := envelope{
+		"status":     status,
+		"checked_at": report.CheckedAt.UTC(),
+		"checks":     checks,
+	}
+
+	err := app.writeJSON(w, code, env, http.Header{"Cache-Control": []string{"no-store"}})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// newHealthChecks function registers the readiness checks of the database, the SMTP server and
+// the background tasks. Only the database checks are critical, the API can still serve requests
+// when the emails can't be sent.
+func newHealthChecks(cfg config, db *sql.DB, m mailer.Mailer, tasks *taskTracker) *health.Registry {
+	registry := health.New(cfg.health.checkTimeout, cfg.health.cacheTTL)
+
+	registry.Register("database", true, func(ctx context.Context) error {
+		return db.PingContext(ctx)
+	})
+
+	registry.Register("database_migrations", true, func(ctx context.Context) error {
+		version, dirty, err := data.MigrationVersion(ctx, db)
+		if err != nil {
+			return err
+		}
+
+		if dirty {
+			return fmt.Errorf("migration %d failed and left the schema dirty", version)
+		}
+
+		if version < cfg.health.migrationVersion {
+			return fmt.Errorf("schema is at version %d, version %d is required", version, cfg.health.migrationVersion)
+		}
+
+		return nil
+	})
+
+	registry.Register("database_pool", false, func(ctx context.Context) error {
+		stats := db.Stats()
+		if stats.MaxOpenConnections == 0 {
+			return nil
+		}
+
+		usage := float64(stats.InUse) / float64(stats.MaxOpenConnections)
+		if usage >= cfg.health.maxPoolUsage {
+			return fmt.Errorf("%d of %d connections in use", stats.InUse, stats.MaxOpenConnections)
+		}
+
+		return nil
+	})
+
+	registry.Register("smtp", false, func(ctx context.Context) error {
+		return m.Ping()
+	})
+
+	registry.Register("background_tasks", false, func(ctx context.Context) error {
+		running, oldest := tasks.stats()
+		if oldest > cfg.health.maxTaskAge {
+			return fmt.Errorf("oldest of %d running tasks started %s ago", running, oldest.Round(time.Second))
+		}
+
+		return nil
+	})
+
+	return registry
+}
+
+// taskTracker struct records the start time of the tasks started with app.background(), so that
+// the readiness check can report when they fall behind (e.g. emails stuck on a slow SMTP server).
+type taskTracker struct {
+	mu      sync.Mutex
+	nextID  uint64
+	started map[uint64]time.Time
+}
+
+func newTaskTracker() *taskTracker {
+	return &taskTracker{started: make(map[uint64]time.Time)}
+}
+
+// start records a new running task and returns its id, to be passed to done().
+func (t *taskTracker) start() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nextID++
+	t.started[t.nextID] = time.Now()
+
+	return t.nextID
+}
+
+func (t *taskTracker) done(id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.started, id)
+}
+
+// stats returns the number of running tasks and for how long the oldest one has been running.
+func (t *taskTracker) stats() (int, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var oldest time.Duration
+	for _, started := range t.started {
+		if age := time.Since(started); age > oldest {
+			oldest = age
+		}
+	}
+
+	return len(t.started), oldest
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
+	"github.com/luca0x333/go-greenlight/internal/data"
 	"github.com/luca0x333/go-greenlight/internal/validator"
 	"io"
 	"net/http"
@@ -165,12 +166,61 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// readBool helper reads an optional boolean value from the query string. It returns nil if the
+// key isn't found, and records an error message into the validator if it isn't a boolean.
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return nil
+	}
+
+	return &b
+}
+
+// cacheHeaders helper returns the headers describing a response built from a cached read.
+// Max-age is the time left before the entry expires and Age how old the entry is.
+// No header is returned when caching is disabled.
+func (app *application) cacheHeaders(info data.CacheInfo) http.Header {
+	if info.TTL == 0 {
+		return nil
+	}
+
+	headers := make(http.Header)
+
+	maxAge := info.TTL - info.Age
+	if maxAge < 0 {
+		maxAge = 0
+	}
+
+	headers.Set("Cache-Control", fmt.Sprintf("max-age=%d", int(maxAge.Seconds())))
+	headers.Set("Age", strconv.Itoa(int(info.Age.Seconds())))
+
+	if info.Hit {
+		headers.Set("X-Cache", "HIT")
+	} else {
+		headers.Set("X-Cache", "MISS")
+	}
+
+	return headers
+}
+
 func (app *application) background(fn func()) {
 	app.wg.Add(1)
+	app.metrics.backgroundTasks.Inc()
+	taskID := app.tasks.start()
 
 	// Launch a background routine
 	go func() {
 		defer app.wg.Done()
+		defer app.metrics.backgroundTasks.Dec()
+		defer app.tasks.done(taskID)
 
 		// Recover any panic.
 		defer func() {
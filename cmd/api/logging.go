@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"github.com/luca0x333/go-greenlight/internal/jsonlog"
+	"github.com/luca0x333/go-greenlight/internal/validator"
+	"io"
+	"net/http"
+	"os"
+)
+
+// newLogger function returns the application logger writing to stdout and, when a log file is
+// configured, to a rotating file with its own minimum level. The returned io.Closer closes the
+// log file and is nil when there is none.
+func newLogger(cfg config) (*jsonlog.Logger, io.Closer, error) {
+	level, err := jsonlog.ParseLevel(cfg.log.level)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stackTraceLevel, err := jsonlog.ParseLevel(cfg.log.stackTraceLevel)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sinks := []jsonlog.Sink{{Out: os.Stdout, MinLevel: jsonlog.LevelDebug}}
+
+	var (
+		file   *jsonlog.RotatingFile
+		logger *jsonlog.Logger
+	)
+
+	if cfg.log.file.path != "" {
+		fileLevel, err := jsonlog.ParseLevel(cfg.log.file.level)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		file, err = jsonlog.OpenRotatingFile(cfg.log.file.path, jsonlog.RotateOptions{
+			MaxSize:    int64(cfg.log.file.maxSize) * 1024 * 1024,
+			Interval:   cfg.log.file.rotateInterval,
+			MaxBackups: cfg.log.file.maxBackups,
+			Compress:   cfg.log.file.compress,
+			// The entries are still written to the current file, and to stdout.
+			OnError: func(err error) {
+				logger.PrintError(err, map[string]interface{}{"component": "log_rotation"})
+			},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sinks = append(sinks, jsonlog.Sink{Out: file, MinLevel: fileLevel})
+	}
+
+	logger = jsonlog.NewWithSinks(level, sinks...)
+	logger.SetStackTraceLevel(stackTraceLevel)
+
+	if file == nil {
+		return logger, nil, nil
+	}
+
+	return logger, file, nil
+}
+
+// showLogLevelHandler method returns the current minimum level of the logger.
+func (app *application) showLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"level": app.logger.Level().String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateLogLevelHandler method changes the minimum level of the logger at runtime,
+// e.g. to temporarily enable the DEBUG entries while investigating an issue.
+func (app *application) updateLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Level *string `json:"level"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Level == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain a level"))
+		return
+	}
+
+	v := validator.New()
+
+	level, err := jsonlog.ParseLevel(*input.Level)
+	v.Check(err == nil, "level", "must be one of debug, info, warn, error, fatal or off")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	previous := app.logger.Level()
+	app.logger.SetLevel(level)
+
+	app.logger.PrintWarnCtx(r.Context(), "log level changed", map[string]interface{}{
+		"previous_level": previous.String(),
+		"level":          level.String(),
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"level": level.String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
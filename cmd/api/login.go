@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"github.com/luca0x333/go-greenlight/internal/data"
+	"github.com/luca0x333/go-greenlight/internal/validator"
+	"net/http"
+	"time"
+)
+
+// loginFreeFailures is the number of consecutive failed logins of an account, e.g. typos, before
+// the next logins are delayed.
+const loginFreeFailures = 3
+
+// loginDelay function returns the delay imposed on the next login of an account after the given
+// number of consecutive failures: -login-delay after loginFreeFailures failures, doubled on each
+// further failure, up to -login-max-delay.
+func loginDelay(cfg config, failures int) time.Duration {
+	if cfg.login.delay == 0 || failures < loginFreeFailures {
+		return 0
+	}
+
+	delay := cfg.login.delay
+	for i := loginFreeFailures; i < failures && delay < cfg.login.maxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > cfg.login.maxDelay {
+		delay = cfg.login.maxDelay
+	}
+
+	return delay
+}
+
+// loginRetryAfter function returns how long the client must wait before the next login, given the
+// failed logins of the account and of the IP address, or 0 if the login is allowed now. The
+// lockouts apply to both, the delays only to the accounts: the clients behind a shared IP address
+// would be delayed by each other.
+func loginRetryAfter(cfg config, attempts []*data.LoginAttempt, now time.Time) time.Duration {
+	var retryAfter time.Duration
+
+	for _, attempt := range attempts {
+		if attempt.LockedUntil != nil && attempt.LockedUntil.After(now) {
+			if d := attempt.LockedUntil.Sub(now); d > retryAfter {
+				retryAfter = d
+			}
+		}
+
+		if attempt.Kind == data.LoginAttemptAccount {
+			allowedAt := attempt.LastFailureAt.Add(loginDelay(cfg, attempt.Failures))
+			if d := allowedAt.Sub(now); d > retryAfter {
+				retryAfter = d
+			}
+		}
+	}
+
+	return retryAfter
+}
+
+// checkLoginAttempts method returns how long the client must wait before logging in with the
+// email address, see loginRetryAfter(). The email address doesn't need to be registered: the
+// unknown ones are delayed and locked out too, so that the responses don't tell them apart.
+func (app *application) checkLoginAttempts(r *http.Request, email string) (time.Duration, error) {
+	cfg := app.currentConfig()
+	now := time.Now()
+
+	attempts, err := app.models.LoginAttempts.Get(r.Context(), email, app.contextGetClientIP(r), now.Add(-cfg.login.lockoutDuration))
+	if err != nil {
+		return 0, err
+	}
+
+	return loginRetryAfter(cfg, attempts, now), nil
+}
+
+// recordFailedLogin method counts a failed login against the account and the client IP address.
+// When the failure locks out the account of a registered user, the user is notified by email:
+// either they forgot their password or someone is trying to guess it.
+func (app *application) recordFailedLogin(r *http.Request, email string, user *data.User) error {
+	cfg := app.currentConfig()
+	ip := app.contextGetClientIP(r)
+	now := time.Now()
+	since := now.Add(-cfg.login.lockoutDuration)
+	lockedUntil := now.Add(cfg.login.lockoutDuration)
+
+	locked, err := app.models.LoginAttempts.RecordFailure(r.Context(), data.LoginAttemptAccount, email, now, since, cfg.login.accountLockoutThreshold, lockedUntil)
+	if err != nil {
+		return err
+	}
+
+	if locked {
+		app.logger.PrintWarnCtx(r.Context(), "account locked out", map[string]interface{}{
+			"locked_until": lockedUntil,
+			"user_id":      userID(user),
+		})
+
+		if user != nil {
+			app.background(func() {
+				err := app.mailer.Send(r.Context(), user.Email, "login_lockout.tmpl", map[string]interface{}{
+					"Name":        user.Name,
+					"LockedUntil": lockedUntil.UTC().Format(time.RFC1123),
+					"ClientIP":    ip,
+				})
+				if err != nil {
+					app.logger.PrintErrorCtx(r.Context(), err, nil)
+				}
+			})
+		}
+	}
+
+	locked, err = app.models.LoginAttempts.RecordFailure(r.Context(), data.LoginAttemptIP, ip, now, since, cfg.login.ipLockoutThreshold, lockedUntil)
+	if err != nil {
+		return err
+	}
+
+	if locked {
+		app.logger.PrintWarnCtx(r.Context(), "client ip locked out", map[string]interface{}{
+			"locked_until": lockedUntil,
+		})
+	}
+
+	return nil
+}
+
+// userID function returns the ID of the user, or 0 if the user isn't registered.
+func userID(user *data.User) int64 {
+	if user == nil {
+		return 0
+	}
+
+	return user.ID
+}
+
+// listLoginAttemptsHandler method returns the accounts and the client IP addresses with recent
+// failed logins, including the locked out ones.
+func (app *application) listLoginAttemptsHandler(w http.ResponseWriter, r *http.Request) {
+	since := time.Now().Add(-app.currentConfig().login.lockoutDuration)
+
+	attempts, err := app.models.LoginAttempts.GetAll(r.Context(), since)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"login_attempts": attempts}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteLoginAttemptsHandler method unlocks an account (by email address) or a client IP
+// address, forgetting its failed logins, e.g. DELETE /debug/login-attempts/account/alice@example.com.
+func (app *application) deleteLoginAttemptsHandler(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	kind, key := params.ByName("kind"), params.ByName("key")
+
+	v := validator.New()
+
+	v.Check(validator.In(kind, data.LoginAttemptAccount, data.LoginAttemptIP), "kind", "must be account or ip")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err := app.models.LoginAttempts.Delete(r.Context(), kind, key)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.logger.PrintInfoCtx(r.Context(), "login attempts deleted", map[string]interface{}{
+		"kind": kind,
+		"key":  key,
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": kind + " successfully unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
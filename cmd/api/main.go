@@ -3,13 +3,25 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/hex"
+	"errors"
+	"expvar"
 	"flag"
+	"fmt"
 	_ "github.com/lib/pq"
+	"github.com/luca0x333/go-greenlight/internal/cache"
 	"github.com/luca0x333/go-greenlight/internal/data"
+	"github.com/luca0x333/go-greenlight/internal/health"
 	"github.com/luca0x333/go-greenlight/internal/jsonlog"
 	"github.com/luca0x333/go-greenlight/internal/mailer"
+	"github.com/luca0x333/go-greenlight/internal/oidc"
+	"github.com/luca0x333/go-greenlight/internal/ratelimit"
+	"github.com/luca0x333/go-greenlight/internal/secretbox"
+	"github.com/luca0x333/go-greenlight/internal/tracing"
+	"net/http"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,18 +29,25 @@ const version = "1.0.0"
 
 // Define a config struct to hold all the configuration settings for our application.
 type config struct {
-	port int
-	env  string
-	db   struct {
+	port               int
+	env                string
+	adminAddr          string
+	trustedProxies     []string
+	shutdownDrainDelay time.Duration
+	db                 struct {
 		dsn          string
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  string
 	}
 	limiter struct {
-		rps     float64
-		burst   int
-		enabled bool
+		rps         float64
+		burst       int
+		enabled     bool
+		authRps     float64
+		authBurst   int
+		exemptCIDRs []string
+		store       string
 	}
 	smtp struct {
 		host     string
@@ -37,43 +56,138 @@ type config struct {
 		password string
 		sender   string
 	}
+	cache struct {
+		enabled bool
+		size    int
+		ttl     time.Duration
+	}
+	tracing struct {
+		exporter    string
+		endpoint    string
+		serviceName string
+	}
+	accessLog struct {
+		enabled       bool
+		format        string
+		sampleRate    float64
+		slowThreshold time.Duration
+	}
+	login struct {
+		delay                   time.Duration
+		maxDelay                time.Duration
+		accountLockoutThreshold int
+		ipLockoutThreshold      int
+		lockoutDuration         time.Duration
+	}
+	totp struct {
+		encryptionKey string
+		issuer        string
+	}
+	oidc struct {
+		issuer        string
+		clientID      string
+		clientSecret  string
+		redirectURL   string
+		autoProvision bool
+	}
+	cors struct {
+		trustedOrigins   []string
+		allowCredentials bool
+		maxAge           time.Duration
+	}
+	tls struct {
+		cert               string
+		key                string
+		clientCA           string
+		servicePermissions []string
+		reloadInterval     time.Duration
+		redirectAddr       string
+	}
+	health struct {
+		checkTimeout     time.Duration
+		cacheTTL         time.Duration
+		migrationVersion int64
+		maxPoolUsage     float64
+		maxTaskAge       time.Duration
+	}
+	log struct {
+		level           string
+		stackTraceLevel string
+		file            struct {
+			path           string
+			level          string
+			maxSize        int
+			rotateInterval time.Duration
+			maxBackups     int
+			compress       bool
+		}
+	}
 }
 
 // Define an application struct to hold the dependencies for our HTTP handlers, helpers and middleware.
+// config holds the current config, which is swapped on SIGHUP, read it with currentConfig().
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config    atomic.Value
+	logger    *jsonlog.Logger
+	models    data.Models
+	mailer    mailer.Mailer
+	metrics   *appMetrics
+	accessLog *accessLogWriter
+	health    *health.Registry
+	limiter   ratelimit.Store
+	oidc      *oidc.Provider
+	tasks     *taskTracker
+	wg        sync.WaitGroup
 }
 
 func main() {
-	// Declare an instance of the config struct.
-	var cfg config
+	// The "config print" subcommand shows the effective configuration and exits.
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "print" {
+		err := printConfig(os.Stdout, os.Args[3:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	flag.IntVar(&cfg.port, "port", 4000, "API server port")
-	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	// Load the configuration from the defaults, the config file, the environment and the flags.
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		jsonlog.New(os.Stdout, jsonlog.LevelInfo).PrintFatal(err, nil)
+	}
 
-	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("PGSQL_DSN"), "PostgreSQL DSN")
-	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
-	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
-	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
+	// Initialize the logger writing to stdout, and to the log file when one is configured.
+	logger, logFile, err := newLogger(cfg)
+	if err != nil {
+		jsonlog.New(os.Stdout, jsonlog.LevelInfo).PrintFatal(err, nil)
+	}
+	if logFile != nil {
+		defer logFile.Close()
+	}
 
-	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
-	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
-	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	// Set up the tracer used for the spans of the requests, queries and emails.
+	tracer, err := newTracer(cfg, func(err error) {
+		logger.PrintError(err, map[string]interface{}{"component": "tracing"})
+	})
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
 
-	flag.StringVar(&cfg.smtp.host, "smtp-host", "smtp.mailtrap.io", "SMTP host")
-	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
-	flag.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
-	flag.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
-	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Test <no-reply@test.test.com>", "SMTP sender")
+	if tracer != nil {
+		tracing.SetTracer(tracer)
 
-	flag.Parse()
+		// Export the remaining spans once the server has stopped.
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
 
-	// Initialize a new logger which writes any messages at o above the INFO level.
-	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+			tracer.Shutdown(ctx)
+		}()
+	}
 
 	// Call openDB() helper to create a connection pool, passing in the config struct.
 	db, err := openDB(cfg)
@@ -84,13 +198,65 @@ func main() {
 
 	logger.PrintInfo("database connection pool established", nil)
 
+	models := data.NewModels(db)
+
+	// Encrypt the TOTP secrets of the users. Two-factor authentication is unavailable without a key.
+	if cfg.totp.encryptionKey != "" {
+		// The key was validated by loadConfig().
+		key, _ := hex.DecodeString(cfg.totp.encryptionKey)
+
+		box, err := secretbox.New(key)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		models = models.WithSecretBox(box)
+	}
+
+	// Put the in-process LRU cache in front of the movie reads, and publish its
+	// statistics in the expvar handler.
+	if cfg.cache.enabled {
+		cacheStats := &cache.Stats{}
+		models = models.WithMovieCache(cache.NewLRU(cfg.cache.size, cacheStats), cfg.cache.ttl, cacheStats)
+
+		expvar.Publish("movie_cache", expvar.Func(func() interface{} {
+			return cacheStats.Snapshot()
+		}))
+	}
+
+	appMailer := mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender)
+
+	tasks := newTaskTracker()
+
+	limiter := newLimiterStore(cfg, db, logger)
+	defer limiter.Close()
+
+	// The OIDC login is unavailable without an issuer. The provider is only contacted on the
+	// first login, so that the API starts even if it is down.
+	var oidcProvider *oidc.Provider
+	if cfg.oidc.issuer != "" {
+		oidcProvider = oidc.NewProvider(oidc.Config{
+			Issuer:       cfg.oidc.issuer,
+			ClientID:     cfg.oidc.clientID,
+			ClientSecret: cfg.oidc.clientSecret,
+			RedirectURL:  cfg.oidc.redirectURL,
+			Scopes:       []string{"openid", "email", "profile"},
+		}, &http.Client{Timeout: 10 * time.Second})
+	}
+
 	// Declare a new instance of the application struct.
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		logger:    logger,
+		models:    models,
+		mailer:    appMailer,
+		metrics:   newAppMetrics(db, appMailer),
+		accessLog: &accessLogWriter{out: os.Stdout},
+		health:    newHealthChecks(cfg, db, appMailer, tasks),
+		tasks:     tasks,
+		limiter:   limiter,
+		oidc:      oidcProvider,
 	}
+	app.config.Store(cfg)
 
 	err = app.serve()
 	if err != nil {
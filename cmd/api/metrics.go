@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/luca0x333/go-greenlight/internal/mailer"
+	"github.com/luca0x333/go-greenlight/internal/metrics"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// appMetrics struct holds the metrics updated by the application, and the registry which
+// renders them together with the ones read at scrape time.
+type appMetrics struct {
+	registry            *metrics.Registry
+	requests            *metrics.CounterVec
+	requestDuration     *metrics.HistogramVec
+	requestsInFlight    *metrics.Gauge
+	rateLimitRejections *metrics.CounterVec
+	backgroundTasks     *metrics.Gauge
+}
+
+// newAppMetrics function registers all the application metrics, including the database
+// connection pool and mailer statistics which are read from db and m when scraped.
+func newAppMetrics(db *sql.DB, m mailer.Mailer) *appMetrics {
+	registry := metrics.New()
+
+	am := &appMetrics{
+		registry: registry,
+		requests: registry.NewCounterVec("greenlight_http_requests_total",
+			"Total number of HTTP requests processed.", "method", "route", "status"),
+		requestDuration: registry.NewHistogramVec("greenlight_http_request_duration_seconds",
+			"HTTP request latencies in seconds.", metrics.DefaultBuckets, "method", "route", "status"),
+		requestsInFlight: registry.NewGauge("greenlight_http_requests_in_flight",
+			"Number of HTTP requests currently being processed."),
+		rateLimitRejections: registry.NewCounterVec("greenlight_rate_limit_rejections_total",
+			"Total number of requests rejected by the rate limiter.", "route"),
+		backgroundTasks: registry.NewGauge("greenlight_background_goroutines",
+			"Number of background goroutines started with app.background() still running."),
+	}
+
+	// sql.DB.Stats() is cheap but takes a lock, so it is read once per metric at scrape time.
+	dbStats := func(fn func(sql.DBStats) float64) func() float64 {
+		return func() float64 {
+			return fn(db.Stats())
+		}
+	}
+
+	registry.NewGaugeFunc("greenlight_db_max_open_connections", "Maximum number of open connections to the database.",
+		dbStats(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+	registry.NewGaugeFunc("greenlight_db_open_connections", "Number of established connections, both in use and idle.",
+		dbStats(func(s sql.DBStats) float64 { return float64(s.OpenConnections) }))
+	registry.NewGaugeFunc("greenlight_db_in_use_connections", "Number of connections currently in use.",
+		dbStats(func(s sql.DBStats) float64 { return float64(s.InUse) }))
+	registry.NewGaugeFunc("greenlight_db_idle_connections", "Number of idle connections.",
+		dbStats(func(s sql.DBStats) float64 { return float64(s.Idle) }))
+	registry.NewCounterFunc("greenlight_db_wait_count_total", "Total number of connections waited for.",
+		dbStats(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+	registry.NewCounterFunc("greenlight_db_wait_duration_seconds_total", "Total time blocked waiting for a new connection.",
+		dbStats(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+	registry.NewCounterFunc("greenlight_db_max_idle_closed_total", "Total number of connections closed due to SetMaxIdleConns.",
+		dbStats(func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }))
+	registry.NewCounterFunc("greenlight_db_max_idle_time_closed_total", "Total number of connections closed due to SetConnMaxIdleTime.",
+		dbStats(func(s sql.DBStats) float64 { return float64(s.MaxIdleTimeClosed) }))
+	registry.NewCounterFunc("greenlight_db_max_lifetime_closed_total", "Total number of connections closed due to SetConnMaxLifetime.",
+		dbStats(func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }))
+
+	registry.NewCounterFunc("greenlight_mailer_sent_total", "Total number of emails successfully sent.",
+		func() float64 { return float64(m.Stats().Sent) })
+	registry.NewCounterFunc("greenlight_mailer_failed_total", "Total number of emails which couldn't be sent after all the retries.",
+		func() float64 { return float64(m.Stats().Failed) })
+
+	return am
+}
+
+// metricsResponseWriter wraps a http.ResponseWriter to record the status code and the number
+// of bytes written in the response.
+type metricsResponseWriter struct {
+	wrapped       http.ResponseWriter
+	statusCode    int
+	bytes         int
+	headerWritten bool
+}
+
+func newMetricsResponseWriter(w http.ResponseWriter) *metricsResponseWriter {
+	return &metricsResponseWriter{
+		wrapped:    w,
+		statusCode: http.StatusOK,
+	}
+}
+
+func (mw *metricsResponseWriter) Header() http.Header {
+	return mw.wrapped.Header()
+}
+
+func (mw *metricsResponseWriter) WriteHeader(statusCode int) {
+	mw.wrapped.WriteHeader(statusCode)
+
+	if !mw.headerWritten {
+		mw.statusCode = statusCode
+		mw.headerWritten = true
+	}
+}
+
+func (mw *metricsResponseWriter) Write(b []byte) (int, error) {
+	mw.headerWritten = true
+
+	n, err := mw.wrapped.Write(b)
+	mw.bytes += n
+
+	return n, err
+}
+
+// Unwrap returns the original http.ResponseWriter.
+func (mw *metricsResponseWriter) Unwrap() http.ResponseWriter {
+	return mw.wrapped
+}
+
+// recordMetrics middleware records the number of requests, their latency and the number of
+// in-flight requests. The route label is the httprouter pattern recorded by the router.
+func (app *application) recordMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		app.metrics.requestsInFlight.Inc()
+		defer app.metrics.requestsInFlight.Dec()
+
+		mw := newMetricsResponseWriter(w)
+
+		next.ServeHTTP(mw, r)
+
+		route := app.contextGetRoutePattern(r)
+		status := strconv.Itoa(mw.statusCode)
+
+		app.metrics.requests.Inc(r.Method, route, status)
+		app.metrics.requestDuration.Observe(time.Since(start).Seconds(), r.Method, route, status)
+	})
+}
@@ -1,14 +1,54 @@
 package main
 
 import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"golang.org/x/time/rate"
+	"github.com/luca0x333/go-greenlight/internal/data"
+	"github.com/luca0x333/go-greenlight/internal/jsonlog"
+	"github.com/luca0x333/go-greenlight/internal/ratelimit"
+	"github.com/luca0x333/go-greenlight/internal/validator"
 	"net"
 	"net/http"
-	"sync"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// requestIDRX matches the request IDs we accept from the clients: up to 128 characters which are
+// safe to echo in a header and in the logs.
+var requestIDRX = regexp.MustCompile(`^[a-zA-Z0-9._\-]{1,128}$`)
+
+// requestID middleware stores the ID of the request in the request context and echoes it in the
+// X-Request-ID response header. The client (or a proxy) provided ID is used if it is valid,
+// otherwise a random one is generated. As the first middleware of the chain, it also adds the
+// requestInfo filled in by the inner layers.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+
+		if !requestIDRX.MatchString(id) {
+			b := make([]byte, 16)
+
+			_, err := rand.Read(b)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		r = app.contextSetRequestInfo(r)
+		next.ServeHTTP(w, app.contextSetRequestID(r, id))
+	})
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// This anonymous function will always be run in the event of panic.
@@ -29,72 +69,307 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-func (app *application) rateLimit(next http.Handler) http.Handler {
-	// Define a client struct to hold the rate limiter and last seen time for each client.
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
-	}
+// authenticate middleware adds the user of the request to the context: the owner of the bearer
+// token or of the API key of the Authorization header, or the AnonymousUser when there is no
+// such header. The requests authenticated with an API key also get the key in their context,
+// which restricts the permissions of the user, see requirePermission().
+func (app *application) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The response depends on the Authorization header, the caches must not share it
+		// across users.
+		w.Header().Add("Vary", "Authorization")
 
-	// Declare a mutex and a map to hold the clients' IP addresses and rate limiters.
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
-
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-
-			// Lock the mutex to prevent any rate limiter checks from happening while
-			// the cleanup is taking place.
-			mu.Lock()
-
-			// Loop through all clients. If they haven't been seen within the last three
-			// minutes, delete the corresponding entry from the map.
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
-				}
-			}
+		authorizationHeader := r.Header.Get("Authorization")
 
-			mu.Unlock()
+		if authorizationHeader == "" {
+			r = app.contextSetUser(r, data.AnonymousUser)
+			next.ServeHTTP(w, r)
+			return
 		}
-	}()
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if app.config.limiter.enabled {
-			// Extract the client's IP address from the request.
-			ip, _, err := net.SplitHostPort(r.RemoteAddr)
-			if err != nil {
+		// The header is expected in the "Bearer <token>" or "ApiKey <key>" format.
+		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) != 2 || (headerParts[0] != "Bearer" && headerParts[0] != "ApiKey") {
+			app.rejectCredentials(w, r, app.invalidAuthenticationTokenResponse)
+			return
+		}
+
+		if headerParts[0] == "ApiKey" {
+			app.authenticateAPIKey(w, r, headerParts[1], next)
+			return
+		}
+
+		token := headerParts[1]
+
+		v := validator.New()
+
+		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+			app.rejectCredentials(w, r, app.invalidAuthenticationTokenResponse)
+			return
+		}
+
+		user, err := app.models.Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.rejectCredentials(w, r, app.invalidAuthenticationTokenResponse)
+			default:
 				app.serverErrorResponse(w, r, err)
-				return
 			}
+			return
+		}
+
+		// The tokens are deleted when the user is deactivated, this only rejects the requests
+		// racing with the deactivation.
+		if !user.Activated {
+			app.inactiveAccountResponse(w, r)
+			return
+		}
+
+		r = app.contextSetUser(r, user)
+		next.ServeHTTP(w, r)
+	})
+}
 
-			// Lock the mutex to prevent this code from being executed concurrently.
-			mu.Lock()
+// requireAuthenticatedUser middleware rejects the anonymous requests.
+func (app *application) requireAuthenticatedUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetUser(r).IsAnonymous() {
+			app.authenticationRequiredResponse(w, r)
+			return
+		}
 
-			// Create and add a new client struct to the map if it doesn't already exist.
-			if _, found := clients[ip]; !found {
-				clients[ip] = &client{
-					limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst),
-				}
-			}
+		next.ServeHTTP(w, r)
+	})
+}
 
-			// Update the lastSeen time for the client.
-			clients[ip].lastSeen = time.Now()
+// newLimiterStore function returns the store of the rate limiter state. With -limiter-store=postgres
+// the limits are shared by all the instances of the API, and each instance falls back to limiting
+// locally while the database is unavailable.
+func newLimiterStore(cfg config, db *sql.DB, logger *jsonlog.Logger) ratelimit.Store {
+	local := ratelimit.NewMemoryStore(3 * time.Minute)
 
-			// Call the Allow() method on the rate limiter for the current IP address.
-			// If the request isn't allowed, unlock the mutex and send a 429 Too Many Requests response.
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
-				app.rateLimitExceededResponse(w, r)
-				return
-			}
+	if cfg.limiter.store != "postgres" {
+		return local
+	}
 
-			mu.Unlock()
+	shared := ratelimit.NewPostgresStore(db, 250*time.Millisecond)
+
+	return ratelimit.NewFallbackStore(shared, local, 30*time.Second, func(err error) {
+		logger.PrintError(err, map[string]interface{}{
+			"component": "limiter",
+			"fallback":  "memory",
+		})
+	})
+}
+
+// authenticateAPIKey method authenticates the request with the API key, see authenticate().
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, plaintext string, next http.Handler) {
+	v := validator.New()
+
+	if data.ValidateAPIKeyPlaintext(v, plaintext); !v.Valid() {
+		app.rejectCredentials(w, r, app.invalidAPIKeyResponse)
+		return
+	}
+
+	key, user, err := app.models.APIKeys.GetForKey(r.Context(), plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.rejectCredentials(w, r, app.invalidAPIKeyResponse)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !user.Activated {
+		app.inactiveAccountResponse(w, r)
+		return
+	}
+
+	r = app.contextSetAPIKey(r, key)
+	r = app.contextSetUser(r, user)
+	next.ServeHTTP(w, r)
+}
+
+// requireUserToken middleware rejects the requests which aren't authenticated with the token of
+// a user: the anonymous ones, and the API keys which can't manage the account of their owner
+// (two-factor authentication, API keys).
+func (app *application) requireUserToken(next http.Handler) http.Handler {
+	return app.requireAuthenticatedUser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.userTokenRequiredResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// requirePermission middleware rejects the requests of the users without the permission. With
+// an API key, the permission must also be one of the key's. The internal callers authenticated
+// by their client certificate alone need the permission to be granted to their identity.
+func (app *application) requirePermission(code string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetUser(r).IsAnonymous() && app.contextGetServiceIdentity(r) == "" {
+			app.authenticationRequiredResponse(w, r)
+			return
+		}
+
+		permissions, err := app.permissionsFor(r)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !permissions.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
+
+// permissionsFor method returns the permissions of the authenticated user of the request,
+// restricted to those of the API key if the request was authenticated with one. The anonymous
+// requests get the permissions granted to their service identity, if any.
+func (app *application) permissionsFor(r *http.Request) (data.Permissions, error) {
+	user := app.contextGetUser(r)
+
+	if user.IsAnonymous() {
+		return app.servicePermissions(app.contextGetServiceIdentity(r)), nil
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if key := app.contextGetAPIKey(r); key != nil {
+		permissions = permissions.Intersect(key.Permissions)
+	}
+
+	return permissions, nil
+}
+
+// Rate limit policies. The routes use the default policy unless they are listed in
+// rateLimitPolicies, in routes.go.
+const (
+	rateLimitPolicyDefault = "default"
+	rateLimitPolicyAuth    = "auth"
+)
+
+// rateLimitFor method returns the limit of a policy in the current config.
+func (app *application) rateLimitFor(policy string) ratelimit.Limit {
+	cfg := app.currentConfig().limiter
+
+	if policy == rateLimitPolicyAuth {
+		return ratelimit.Limit{Rate: cfg.authRps, Burst: cfg.authBurst}
+	}
+
+	return ratelimit.Limit{Rate: cfg.rps, Burst: cfg.burst}
+}
+
+// rateLimit middleware limits the requests to the routes of a policy. The authenticated users are
+// limited individually, the anonymous requests by client IP address, and the policies have
+// separate budgets. The clients in the exempt CIDRs aren't limited. The state of the limit is
+// sent in the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers (in seconds),
+// and Retry-After tells a limited client when to retry.
+func (app *application) rateLimit(policy string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := app.currentConfig().limiter
+
+		if !cfg.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := app.contextGetClientIP(r)
+
+		if ipInCIDRs(net.ParseIP(ip), cfg.exemptCIDRs) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The API keys are limited individually, so that a batch job doesn't use up the budget
+		// of its owner.
+		key := policy + ":ip:" + ip
+		if apiKey := app.contextGetAPIKey(r); apiKey != nil {
+			key = policy + ":apikey:" + strconv.FormatInt(apiKey.ID, 10)
+		} else if user := app.contextGetUser(r); !user.IsAnonymous() {
+			key = policy + ":user:" + strconv.FormatInt(user.ID, 10)
+		}
+
+		if !app.allowRequest(w, r, key, app.rateLimitFor(policy)) {
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowRequest method counts the request against the limit of key and sets the RateLimit
+// headers. If the request isn't allowed, it sends the error response and returns false.
+func (app *application) allowRequest(w http.ResponseWriter, r *http.Request, key string, limit ratelimit.Limit) bool {
+	result, err := app.limiter.Allow(r.Context(), key, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.ResetAfter)))
+
+	// If the request isn't allowed, send a 429 Too Many Requests response.
+	if !result.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+		app.metrics.rateLimitRejections.Inc(app.contextGetRoutePattern(r))
+		app.rateLimitExceededResponse(w, r)
+		return false
+	}
+
+	return true
+}
+
+// rejectCredentials method sends the response for a malformed or unknown token or API key.
+// The rate limiter runs after authenticate and only sees the authenticated requests, so the
+// rejected credentials are counted against the auth limit of the client IP here instead: once
+// it is used up, the client gets a 429 Too Many Requests response rather than another attempt.
+func (app *application) rejectCredentials(w http.ResponseWriter, r *http.Request, respond func(http.ResponseWriter, *http.Request)) {
+	cfg := app.currentConfig().limiter
+
+	ip := app.contextGetClientIP(r)
+
+	if cfg.enabled && !ipInCIDRs(net.ParseIP(ip), cfg.exemptCIDRs) {
+		if !app.allowRequest(w, r, "invalid_credentials:ip:"+ip, app.rateLimitFor(rateLimitPolicyAuth)) {
+			return
+		}
+	}
+
+	respond(w, r)
+}
+
+// ceilSeconds returns the duration in whole seconds, rounded up.
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// ipInCIDRs returns true if ip belongs to one of the CIDRs. The CIDRs were validated when
+// the config was loaded.
+func ipInCIDRs(ip net.IP, cidrs []string) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
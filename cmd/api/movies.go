@@ -47,9 +47,10 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Call the Insert() method passing in a pointer to the validated movie struct.
-	err = app.models.Movies.Insert(movie)
+	err = app.models.Movies.Insert(r.Context(), movie)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		app.constraintErrorResponse(w, r, v, err)
+		return
 	}
 
 	// When sending a HTTP response, we want to include a Location header to let the
@@ -72,7 +73,7 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	movie, err := app.models.Movies.Get(id)
+	movie, info, err := app.models.Movies.GetCached(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -84,7 +85,7 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Encode the struct to JSON and send it as the HTTP response.
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, app.cacheHeaders(info))
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -100,7 +101,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Fetch the existing movie record from the database.
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -156,13 +157,13 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Pass the updated movie record to the Update() method.
-	err = app.models.Movies.Update(movie)
+	err = app.models.Movies.Update(r.Context(), movie)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
-			app.serverErrorResponse(w, r, err)
+			app.constraintErrorResponse(w, r, v, err)
 		}
 		return
 	}
@@ -184,7 +185,7 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// Delete the movie from the database or send a 404 Not Found response to the client
 	// if the record does not exist in the database.
-	err = app.models.Movies.Delete(id)
+	err = app.models.Movies.Delete(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -207,6 +208,9 @@ func (app *application) listMovieHandler(w http.ResponseWriter, r *http.Request)
 	var input struct {
 		Title  string
 		Genres []string
+		Search data.SearchQuery
+		Expr   data.FilterExpr
+		Facets []string
 		data.Filters
 	}
 
@@ -216,23 +220,50 @@ func (app *application) listMovieHandler(w http.ResponseWriter, r *http.Request)
 
 	input.Title = app.readString(qs, "title", "")
 	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.Search = data.ParseSearchQuery(app.readString(qs, "q", ""))
+
+	// Range and set filters are passed as field[operator]=value, e.g. year[gte]=1990.
+	input.Expr = data.ParseMovieFilterExpr(v, qs)
+	input.Facets = app.readCSV(qs, "facets", []string{})
+
+	// When searching, the most relevant movies are returned first unless the client asks otherwise.
+	defaultSort := "id"
+	if input.Search.Raw != "" {
+		defaultSort = "-relevance"
+	}
+
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
-	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	input.Filters.Sort = app.readString(qs, "sort", defaultSort)
+	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "relevance", "-id", "-title", "-year", "-runtime", "-relevance"}
 
+	data.ValidateSearchQuery(v, input.Search)
+	data.ValidateFacets(v, input.Facets)
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, info, err := app.models.Movies.GetAllCached(r.Context(), input.Title, input.Genres, input.Search, input.Expr, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
+	env := envelope{"movies": movies, "metadata": metadata}
+
+	// The facets are only computed, and included in the response, when requested.
+	if len(input.Facets) > 0 {
+		facets, err := app.models.Movies.GetFacets(r.Context(), input.Title, input.Genres, input.Search, input.Expr, input.Facets)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		env["facets"] = facets
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, app.cacheHeaders(info))
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"github.com/luca0x333/go-greenlight/internal/data"
+	"github.com/luca0x333/go-greenlight/internal/oidc"
+	"github.com/luca0x333/go-greenlight/internal/validator"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// oidcStateCookie is the cookie binding the OIDC login to the browser which started it, so that
+// an attacker can't make a victim complete a login started by the attacker.
+const oidcStateCookie = "oidc_state"
+
+// oidcLoginTTL is how long the user has to log in at the provider.
+const oidcLoginTTL = 10 * time.Minute
+
+// oidcLoginHandler method starts an OIDC login: it stores the state, the nonce and the PKCE code
+// verifier of the login, and redirects the browser to the provider. The provider redirects it
+// back to oidcCallbackHandler().
+func (app *application) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.oidcUnavailableResponse(w, r)
+		return
+	}
+
+	login := &data.OIDCLogin{Expiry: time.Now().Add(oidcLoginTTL)}
+
+	for _, value := range []*string{&login.State, &login.Nonce, &login.CodeVerifier} {
+		random, err := oidc.RandomString()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		*value = random
+	}
+
+	authURL, err := app.oidc.AuthCodeURL(r.Context(), login.State, login.Nonce, oidc.CodeChallenge(login.CodeVerifier))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.OIDC.InsertLogin(r.Context(), login)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// SameSite=Lax lets the browser send the cookie on the top level redirection back from the
+	// provider.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    login.State,
+		Path:     "/v1/oidc",
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		Secure:   app.currentConfig().env != "development",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcCallbackHandler method completes an OIDC login: it checks the state against the cookie,
+// exchanges the authorization code for the ID token of the user and verifies it, then logs in
+// the user linked to the identity. A new identity is linked to the user with the same email
+// address, which the provider must have verified, or to a new user with -oidc-auto-provision.
+// The response is the same as for a password login, see completeLogin().
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.oidcUnavailableResponse(w, r)
+		return
+	}
+
+	// The state can't be used twice, whatever the outcome.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Path:     "/v1/oidc",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	qs := r.URL.Query()
+
+	// The provider redirects with an error when the user denies the access, for instance.
+	if qs.Get("error") != "" {
+		app.logger.PrintWarnCtx(r.Context(), "oidc login failed at the provider", map[string]interface{}{
+			"error":             qs.Get("error"),
+			"error_description": qs.Get("error_description"),
+		})
+		app.oidcLoginFailedResponse(w, r, "the identity provider rejected the login: "+qs.Get("error"))
+		return
+	}
+
+	state := qs.Get("state")
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		app.oidcLoginFailedResponse(w, r, "invalid or expired login state")
+		return
+	}
+
+	login, err := app.models.OIDC.ConsumeLogin(r.Context(), state)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.oidcLoginFailedResponse(w, r, "invalid or expired login state")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	rawIDToken, err := app.oidc.Exchange(r.Context(), qs.Get("code"), login.CodeVerifier)
+	if err != nil {
+		app.logger.PrintWarnCtx(r.Context(), "oidc code exchange failed", map[string]interface{}{"error": err.Error()})
+		app.oidcLoginFailedResponse(w, r, "the authorization code couldn't be exchanged")
+		return
+	}
+
+	claims, err := app.oidc.VerifyIDToken(r.Context(), rawIDToken, login.Nonce)
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrInvalidIDToken):
+			app.logger.PrintWarnCtx(r.Context(), "oidc id token rejected", map[string]interface{}{"error": err.Error()})
+			app.oidcLoginFailedResponse(w, r, "invalid ID token")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.userForIdentity(r, claims)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.oidcLoginFailedResponse(w, r, "no user account matches this identity")
+		case errors.Is(err, errUnverifiedEmail):
+			app.oidcLoginFailedResponse(w, r, "the identity provider hasn't verified the email address")
+		case errors.Is(err, data.ErrDuplicateEmail), errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+// errUnverifiedEmail is returned by userForIdentity() when a new identity can't be linked by
+// email address because the provider hasn't verified it.
+var errUnverifiedEmail = errors.New("unverified email address")
+
+// userForIdentity method returns the user linked to the identity of the claims, linking it first
+// to the user with the same verified email address, or to a new user if auto-provisioning is on.
+// It returns data.ErrRecordNotFound if there is no such user.
+func (app *application) userForIdentity(r *http.Request, claims *oidc.Claims) (*data.User, error) {
+	cfg := app.currentConfig()
+
+	user, err := app.models.OIDC.GetUserForIdentity(r.Context(), cfg.oidc.issuer, claims.Subject)
+	if err == nil || !errors.Is(err, data.ErrRecordNotFound) {
+		return user, err
+	}
+
+	// Anybody can claim any email address at some providers, only a verified one identifies
+	// the user.
+	v := validator.New()
+	if data.ValidateEmail(v, claims.Email); !v.Valid() || !bool(claims.EmailVerified) {
+		return nil, errUnverifiedEmail
+	}
+
+	user, err = app.models.Users.GetByEmail(r.Context(), claims.Email)
+	switch {
+	case err == nil:
+		// The password of an account whose email address isn't verified was set by someone who
+		// hasn't proven that they own it, it is replaced so that they can't log in with it.
+		if !user.EmailVerified {
+			err = app.resetUnverifiedUser(r, user)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case errors.Is(err, data.ErrRecordNotFound) && cfg.oidc.autoProvision:
+		user, err = app.provisionUser(r, claims)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	err = app.models.OIDC.LinkIdentity(r.Context(), cfg.oidc.issuer, claims.Subject, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	app.logger.PrintInfoCtx(r.Context(), "oidc identity linked", map[string]interface{}{
+		"user_id": user.ID,
+		"issuer":  cfg.oidc.issuer,
+		"subject": claims.Subject,
+	})
+
+	return user, nil
+}
+
+// resetUnverifiedUser method marks the email address of the user as verified by the provider,
+// with a random password. The TOTP secret, the tokens and the API keys, which may have been set
+// up by the same person as the password, are removed in the same transaction.
+func (app *application) resetUnverifiedUser(r *http.Request, user *data.User) error {
+	err := user.Password.SetRandom()
+	if err != nil {
+		return err
+	}
+
+	user.EmailVerified = true
+
+	err = app.models.Transaction(r.Context(), func(tx data.Models) error {
+		err := tx.Users.Update(r.Context(), user)
+		if err != nil {
+			return err
+		}
+
+		err = tx.TOTP.Disable(r.Context(), user.ID)
+		if err != nil {
+			return err
+		}
+
+		return revokeUserAccess(r.Context(), tx, user.ID)
+	})
+	if err != nil {
+		return err
+	}
+
+	user.TOTPEnabled = false
+
+	return nil
+}
+
+// provisionUser method creates an activated user for the claims, with a random password, and
+// grants the permissions of the registered users.
+func (app *application) provisionUser(r *http.Request, claims *oidc.Claims) (*data.User, error) {
+	user := &data.User{
+		Name:          strings.TrimSpace(claims.Name),
+		Email:         claims.Email,
+		Activated:     true,
+		EmailVerified: true,
+	}
+
+	if user.Name == "" || len(user.Name) > 500 {
+		user.Name = claims.Email[:strings.Index(claims.Email, "@")]
+	}
+
+	err := user.Password.SetRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.Users.Insert(r.Context(), user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.Permissions.AddForUser(r.Context(), user.ID, data.PermissionMoviesRead)
+	if err != nil {
+		return nil, err
+	}
+
+	app.logger.PrintInfoCtx(r.Context(), "oidc user provisioned", map[string]interface{}{
+		"user_id": user.ID,
+	})
+
+	return user, nil
+}
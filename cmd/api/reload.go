@@ -0,0 +1,113 @@
+package main
+
+import (
+	"github.com/luca0x333/go-greenlight/internal/jsonlog"
+	"os"
+	"sort"
+)
+
+// currentConfig method returns the current config. The reloadable settings can change between
+// two calls, a handler should call it once and use the returned copy.
+func (app *application) currentConfig() config {
+	return app.config.Load().(config)
+}
+
+// reloadConfig method re-reads the config file and the environment (the command line flags can't
+// change) and applies the changes to the reloadable settings, the ones copied below. The other
+// settings are used to set up the servers, the database pool, the cache etc. at startup: their
+// changes are rejected and logged, they need a restart. An invalid config is rejected as a whole.
+func (app *application) reloadConfig() {
+	current := app.currentConfig()
+
+	loaded, err := loadConfig(os.Args[1:])
+	if err != nil {
+		app.logger.PrintError(err, map[string]interface{}{"reload": "rejected"})
+		return
+	}
+
+	// Start from the current config so that only the reloadable settings are changed.
+	next := current
+	next.trustedProxies = loaded.trustedProxies
+	next.shutdownDrainDelay = loaded.shutdownDrainDelay
+	next.limiter.rps = loaded.limiter.rps
+	next.limiter.burst = loaded.limiter.burst
+	next.limiter.enabled = loaded.limiter.enabled
+	next.limiter.authRps = loaded.limiter.authRps
+	next.limiter.authBurst = loaded.limiter.authBurst
+	next.limiter.exemptCIDRs = loaded.limiter.exemptCIDRs
+	next.smtp = loaded.smtp
+	next.accessLog.enabled = loaded.accessLog.enabled
+	next.accessLog.format = loaded.accessLog.format
+	next.accessLog.sampleRate = loaded.accessLog.sampleRate
+	next.accessLog.slowThreshold = loaded.accessLog.slowThreshold
+	next.login = loaded.login
+	next.cors = loaded.cors
+	next.tls.servicePermissions = loaded.tls.servicePermissions
+	next.log.level = loaded.log.level
+	next.log.stackTraceLevel = loaded.log.stackTraceLevel
+
+	// The changes are computed on the config which is applied, so that the log always matches
+	// it, and the remaining differences with the loaded config are the rejected changes.
+	changes := diffConfig(current, next)
+
+	for _, change := range diffConfig(next, loaded) {
+		app.logger.PrintWarn("setting can't be reloaded, restart to apply the change", map[string]interface{}{
+			"setting": change.Setting,
+		})
+	}
+
+	if len(changes) == 0 {
+		app.logger.PrintInfo("configuration reloaded", map[string]interface{}{"changes": changes})
+		return
+	}
+
+	// Both levels were validated by loadConfig().
+	level, _ := jsonlog.ParseLevel(next.log.level)
+	stackTraceLevel, _ := jsonlog.ParseLevel(next.log.stackTraceLevel)
+
+	app.logger.SetLevel(level)
+	app.logger.SetStackTraceLevel(stackTraceLevel)
+
+	if next.smtp != current.smtp {
+		app.mailer.Reconfigure(next.smtp.host, next.smtp.port, next.smtp.username, next.smtp.password, next.smtp.sender)
+	}
+
+	app.config.Store(next)
+
+	app.logger.PrintInfo("configuration reloaded", map[string]interface{}{"changes": changes})
+}
+
+// configChange struct describes the change of a setting, with the secrets redacted.
+type configChange struct {
+	Setting string `json:"setting"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+// diffConfig function returns the settings which differ between the two configs, sorted by name.
+func diffConfig(from, to config) []configChange {
+	fromValues, toValues := flatConfig(from, false), flatConfig(to, false)
+	fromRedacted, toRedacted := flatConfig(from, true), flatConfig(to, true)
+
+	names := make([]string, 0, len(fromValues))
+	for name := range fromValues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	changes := []configChange{}
+
+	for _, name := range names {
+		if fromValues[name] == toValues[name] {
+			continue
+		}
+
+		changes = append(changes, configChange{
+			Setting: name,
+			From:    fromRedacted[name],
+			To:      toRedacted[name],
+		})
+	}
+
+	return changes
+}
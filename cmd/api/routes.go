@@ -2,9 +2,24 @@ package main
 
 import (
 	"github.com/julienschmidt/httprouter"
+	"github.com/luca0x333/go-greenlight/internal/data"
 	"net/http"
 )
 
+// rateLimitPolicies maps the routes with a stricter rate limit policy than the default one.
+// Creating accounts and tokens is expensive (bcrypt) and the target of brute force attacks.
+var rateLimitPolicies = map[string]string{
+	"POST /v1/users":                 rateLimitPolicyAuth,
+	"POST /v1/tokens/authentication": rateLimitPolicyAuth,
+	"POST /v1/tokens/two-factor":     rateLimitPolicyAuth,
+	"GET /v1/oidc/login":             rateLimitPolicyAuth,
+	"GET /v1/oidc/callback":          rateLimitPolicyAuth,
+	"PATCH /v1/users/me":             rateLimitPolicyAuth,
+	"POST /v1/users/me/email":        rateLimitPolicyAuth,
+	"PUT /v1/users/email":            rateLimitPolicyAuth,
+	"PUT /v1/users/password":         rateLimitPolicyAuth,
+}
+
 func (app *application) routes() http.Handler {
 	// Initialize a new httprouter router instance.
 	router := httprouter.New()
@@ -12,18 +27,84 @@ func (app *application) routes() http.Handler {
 	// Convert the notFoundResponse() helper to a http.Handler using the
 	// http.HandlerFunc() adapter, and then set it as the custom error handler for 404
 	// Not Found responses.
-	router.NotFound = http.HandlerFunc(app.notFoundResponse)
-	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+	// The unmatched requests are rate limited too.
+	router.NotFound = app.rateLimit(rateLimitPolicyDefault, http.HandlerFunc(app.notFoundResponse))
+	router.MethodNotAllowed = app.rateLimit(rateLimitPolicyDefault, http.HandlerFunc(app.methodNotAllowedResponse))
+
+	// The router answers the OPTIONS requests with the methods of the URL in the Allow header,
+	// preflightHandler() adds the CORS headers of the preflight requests.
+	router.GlobalOPTIONS = http.HandlerFunc(app.preflightHandler)
+
+	// handle registers the handler for the given method and pattern, recording the pattern in
+	// the request context so that the metrics are labelled with the route instead of the raw URL.
+	// The handler is rate limited with the policy of the route.
+	handle := func(method, pattern string, handler http.Handler) {
+		policy, found := rateLimitPolicies[method+" "+pattern]
+		if !found {
+			policy = rateLimitPolicyDefault
+		}
+
+		handler = app.traceMiddleware("rateLimit", app.rateLimit(policy, handler))
+
+		router.Handler(method, pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			app.contextSetRoutePattern(r, pattern)
+			handler.ServeHTTP(w, r)
+		}))
+	}
+
+	handle(http.MethodGet, "/v1/healthcheck", http.HandlerFunc(app.healthCheckHandler))
+	handle(http.MethodGet, "/v1/healthcheck/live", http.HandlerFunc(app.healthCheckHandler))
+	handle(http.MethodGet, "/v1/healthcheck/ready", http.HandlerFunc(app.readinessHandler))
+	handle(http.MethodGet, "/v1/movies", http.HandlerFunc(app.listMovieHandler))
+	handle(http.MethodPost, "/v1/movies", app.requirePermission(data.PermissionMoviesWrite, http.HandlerFunc(app.createMovieHandler)))
+	handle(http.MethodGet, "/v1/movies/:id", http.HandlerFunc(app.showMovieHandler))
+	handle(http.MethodPatch, "/v1/movies/:id", app.requirePermission(data.PermissionMoviesWrite, http.HandlerFunc(app.updateMovieHandler)))
+	handle(http.MethodDelete, "/v1/movies/:id", app.requirePermission(data.PermissionMoviesWrite, http.HandlerFunc(app.deleteMovieHandler)))
+
+	handle(http.MethodPost, "/v1/users", http.HandlerFunc(app.registerUserHandler))
+	handle(http.MethodPut, "/v1/users/email", http.HandlerFunc(app.confirmEmailChangeHandler))
+	handle(http.MethodPut, "/v1/users/password", http.HandlerFunc(app.updateUserPasswordHandler))
+
+	// Account of the authenticated user.
+	handle(http.MethodGet, "/v1/users/me", app.requireAuthenticatedUser(http.HandlerFunc(app.showCurrentUserHandler)))
+	handle(http.MethodPatch, "/v1/users/me", app.requireUserToken(http.HandlerFunc(app.updateCurrentUserHandler)))
+	handle(http.MethodPost, "/v1/users/me/email", app.requireUserToken(http.HandlerFunc(app.requestEmailChangeHandler)))
+
+	// Two-factor authentication of the authenticated user.
+	handle(http.MethodPost, "/v1/users/me/totp", app.requireUserToken(http.HandlerFunc(app.enrollTOTPHandler)))
+	handle(http.MethodPost, "/v1/users/me/totp/confirm", app.requireUserToken(http.HandlerFunc(app.confirmTOTPHandler)))
+	handle(http.MethodDelete, "/v1/users/me/totp", app.requireUserToken(http.HandlerFunc(app.disableTOTPHandler)))
+	handle(http.MethodPost, "/v1/users/me/totp/recovery-codes", app.requireUserToken(http.HandlerFunc(app.regenerateRecoveryCodesHandler)))
+
+	// API keys of the authenticated user, for the machine clients.
+	handle(http.MethodGet, "/v1/api-keys", app.requireUserToken(http.HandlerFunc(app.listAPIKeysHandler)))
+	handle(http.MethodPost, "/v1/api-keys", app.requireUserToken(http.HandlerFunc(app.createAPIKeyHandler)))
+	handle(http.MethodDelete, "/v1/api-keys/:id", app.requireUserToken(http.HandlerFunc(app.deleteAPIKeyHandler)))
+
+	// Management of the user accounts by the administrators.
+	handle(http.MethodGet, "/v1/admin/users", app.requirePermission(data.PermissionUsersAdmin, http.HandlerFunc(app.listUsersHandler)))
+	handle(http.MethodGet, "/v1/admin/users/:id", app.requirePermission(data.PermissionUsersAdmin, http.HandlerFunc(app.showUserHandler)))
+	handle(http.MethodPatch, "/v1/admin/users/:id", app.requirePermission(data.PermissionUsersAdmin, http.HandlerFunc(app.updateUserHandler)))
+	handle(http.MethodDelete, "/v1/admin/users/:id", app.requirePermission(data.PermissionUsersAdmin, http.HandlerFunc(app.deleteUserHandler)))
+	handle(http.MethodPost, "/v1/admin/users/:id/password-reset", app.requirePermission(data.PermissionUsersAdmin, http.HandlerFunc(app.resetUserPasswordHandler)))
+	handle(http.MethodPut, "/v1/admin/users/:id/permissions/:code", app.requirePermission(data.PermissionUsersAdmin, http.HandlerFunc(app.grantUserPermissionHandler)))
+	handle(http.MethodDelete, "/v1/admin/users/:id/permissions/:code", app.requirePermission(data.PermissionUsersAdmin, http.HandlerFunc(app.revokeUserPermissionHandler)))
+	handle(http.MethodGet, "/v1/admin/actions", app.requirePermission(data.PermissionUsersAdmin, http.HandlerFunc(app.listAdminActionsHandler)))
+
+	handle(http.MethodPost, "/v1/tokens/authentication", http.HandlerFunc(app.createAuthenticationTokenHandler))
+	handle(http.MethodPost, "/v1/tokens/two-factor", http.HandlerFunc(app.createTwoFactorAuthenticationTokenHandler))
 
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthCheckHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/movies", app.listMovieHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.createMovieHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.showMovieHandler)
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.updateMovieHandler)
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.deleteMovieHandler)
+	// Login with the OpenID Connect provider, in a browser.
+	handle(http.MethodGet, "/v1/oidc/login", http.HandlerFunc(app.oidcLoginHandler))
+	handle(http.MethodGet, "/v1/oidc/callback", http.HandlerFunc(app.oidcCallbackHandler))
 
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
+	// requestID > resolveClientIP > serviceIdentity > recordMetrics > logAccess > traceRequest > recoverPanic > enableCORS > authenticate > router
+	// Each middleware after traceRequest gets its own span. The rateLimit middleware is applied
+	// per route by handle(), after authenticate so that the users are limited individually.
+	handler := app.traceRequest(
+		app.traceMiddleware("recoverPanic", app.recoverPanic(
+			app.traceMiddleware("enableCORS", app.enableCORS(
+				app.traceMiddleware("authenticate", app.authenticate(router)))))))
 
-	// recoverPanic > rateLimit > router
-	return app.recoverPanic(app.rateLimit(router))
+	return app.requestID(app.resolveClientIP(app.serviceIdentity(app.recordMetrics(app.logAccess(handler)))))
 }
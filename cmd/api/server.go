@@ -12,15 +12,53 @@ import (
 )
 
 func (app *application) serve() error {
+	cfg := app.currentConfig()
+
 	// Declare a new http server with custom settings.
 	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", app.config.port),
+		Addr:         fmt.Sprintf(":%d", cfg.port),
 		Handler:      app.routes(),
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 30 * time.Second,
 	}
 
+	// Serve HTTPS (and HTTP/2) when a certificate is configured, with an optional plain HTTP
+	// listener redirecting to it.
+	var redirectSrv *http.Server
+	if cfg.tls.cert != "" {
+		tlsConfig, reloader, err := app.newTLSConfig(cfg)
+		if err != nil {
+			return err
+		}
+		defer reloader.Stop()
+
+		srv.TLSConfig = tlsConfig
+
+		if cfg.tls.redirectAddr != "" {
+			redirectSrv = &http.Server{
+				Addr:         cfg.tls.redirectAddr,
+				Handler:      app.redirectToHTTPS(cfg.port),
+				IdleTimeout:  time.Minute,
+				ReadTimeout:  10 * time.Second,
+				WriteTimeout: 10 * time.Second,
+			}
+		}
+	}
+
+	// Declare the admin server, listening on a separate (by default local only) address.
+	var adminSrv *http.Server
+	if cfg.adminAddr != "" {
+		adminSrv = &http.Server{
+			Addr:        cfg.adminAddr,
+			Handler:     app.adminRoutes(),
+			IdleTimeout: time.Minute,
+			ReadTimeout: 30 * time.Second,
+			// The CPU profile and the execution trace are collected for 30 seconds by default.
+			WriteTimeout: 2 * time.Minute,
+		}
+	}
+
 	// This channel will be used to receive any errors returned by the graceful Shutdown() function.
 	shutDownError := make(chan error)
 
@@ -28,18 +66,41 @@ func (app *application) serve() error {
 		// Create a quit channel which carries os.Signals values.
 		quit := make(chan os.Signal, 1)
 
-		// Use signal.Notify() to listen for incoming SIGINT and SIGTERM signals and
+		// Use signal.Notify() to listen for incoming SIGINT, SIGTERM and SIGHUP signals and
 		// relay them to the quit channel.
 		// func Notify(c chan<- os.Signal, sig ...os.Signal)
-		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-		// Read the signal from the quit channel.
-		s := <-quit
+		// Read the signals from the quit channel. SIGHUP reloads the configuration,
+		// SIGINT and SIGTERM start the graceful shutdown.
+		var s os.Signal
+		for s = range quit {
+			if s != syscall.SIGHUP {
+				break
+			}
+
+			app.logger.PrintInfo("caught signal", map[string]interface{}{
+				"signal": s.String(),
+			})
+
+			app.reloadConfig()
+		}
 
-		app.logger.PrintInfo("caught signal", map[string]string{
+		app.logger.PrintInfo("caught signal", map[string]interface{}{
 			"signal": s.String(),
 		})
 
+		// Report as not ready from now on, so that the load balancer stops routing new
+		// requests while the in-flight ones complete.
+		app.health.SetShuttingDown()
+
+		// Keep serving until the load balancer has noticed, the new requests would fail
+		// once the listeners are closed.
+		if delay := app.currentConfig().shutdownDrainDelay; delay > 0 {
+			app.logger.PrintInfo("draining", map[string]interface{}{"delay": delay.String()})
+			time.Sleep(delay)
+		}
+
 		// Context with a 5 seconds timeout.
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
@@ -54,8 +115,24 @@ func (app *application) serve() error {
 			shutDownError <- err
 		}
 
+		if redirectSrv != nil {
+			err = redirectSrv.Shutdown(ctx)
+			if err != nil {
+				shutDownError <- err
+			}
+		}
+
+		// The admin server is stopped after the main server so that it stays available
+		// while the in-flight requests are drained.
+		if adminSrv != nil {
+			err = adminSrv.Shutdown(ctx)
+			if err != nil {
+				shutDownError <- err
+			}
+		}
+
 		// Log a message to say that we're waiting for any background goroutines to complete their tasks.
-		app.logger.PrintInfo("completing background tasks", map[string]string{
+		app.logger.PrintInfo("completing background tasks", map[string]interface{}{
 			"addr": srv.Addr,
 		})
 
@@ -66,17 +143,53 @@ func (app *application) serve() error {
 		shutDownError <- nil
 	}()
 
+	// Start the admin server. A failure to listen on the admin address is fatal, as it would
+	// leave the application without any way to be inspected.
+	if adminSrv != nil {
+		go func() {
+			app.logger.PrintInfo("starting admin server", map[string]interface{}{
+				"addr": adminSrv.Addr,
+			})
+
+			err := adminSrv.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.PrintFatal(err, nil)
+			}
+		}()
+	}
+
+	// Start the HTTP to HTTPS redirect server, a failure to listen is fatal too.
+	if redirectSrv != nil {
+		go func() {
+			app.logger.PrintInfo("starting redirect server", map[string]interface{}{
+				"addr": redirectSrv.Addr,
+			})
+
+			err := redirectSrv.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.PrintFatal(err, nil)
+			}
+		}()
+	}
+
 	// Start the HTTP Server
-	app.logger.PrintInfo("starting server", map[string]string{
+	app.logger.PrintInfo("starting server", map[string]interface{}{
 		"addr": srv.Addr,
-		"env":  app.config.env,
+		"env":  cfg.env,
+		"tls":  srv.TLSConfig != nil,
 	})
 
 	// Calling Shutdown() on our server will cause ListenAndServe() to immediately
 	// return a http.ErrServerClosed error. So if we see this error, it is actually a
 	// good thing and an indication that the graceful shutdown has started. So we check
 	// specifically for this, only returning the error if it is NOT http.ErrServerClosed.
-	err := srv.ListenAndServe()
+	// The certificate is served by TLSConfig.GetCertificate, hence the empty file names.
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
@@ -89,7 +202,7 @@ func (app *application) serve() error {
 	}
 
 	// At this point the shutdown completed successfully.
-	app.logger.PrintInfo("stopped server", map[string]string{
+	app.logger.PrintInfo("stopped server", map[string]interface{}{
 		"addr": srv.Addr,
 	})
 
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/luca0x333/go-greenlight/internal/data"
+	"github.com/luca0x333/go-greenlight/internal/tlsutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// newTLSConfig method returns the TLS configuration of the API server, serving the certificate of
+// -tls-cert and -tls-key and verifying the client certificates with -tls-client-ca, if any, which
+// are reloaded when the files change. The returned reloader must be stopped once the server has
+// stopped.
+func (app *application) newTLSConfig(cfg config) (*tls.Config, *tlsutil.CertReloader, error) {
+	reloader, err := tlsutil.NewCertReloader(cfg.tls.cert, cfg.tls.key, cfg.tls.clientCA)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reloader.Watch(cfg.tls.reloadInterval, func(err error) {
+		if err != nil {
+			app.logger.PrintError(err, map[string]interface{}{"component": "tls"})
+			return
+		}
+
+		app.logger.PrintInfo("tls certificate reloaded", map[string]interface{}{
+			"cert":      cfg.tls.cert,
+			"client_ca": cfg.tls.clientCA,
+		})
+	})
+
+	return tlsutil.ServerConfig(reloader), reloader, nil
+}
+
+// redirectToHTTPS method returns the handler of the -tls-redirect-addr listener, which redirects
+// every request to the same URL on the HTTPS port. 308 Permanent Redirect is used so that the
+// clients don't change the method or drop the body of the request.
+func (app *application) redirectToHTTPS(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// serviceIdentity middleware records the identity of the internal callers which authenticated
+// with a client certificate, see tlsutil.Identity(). The TLS handshake has already verified the
+// certificate against the -tls-client-ca pool. The identity gets the permissions granted by
+// -tls-service-permissions, see permissionsFor().
+func (app *application) serviceIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+			identity := tlsutil.Identity(r.TLS.VerifiedChains[0][0])
+			if identity != "" {
+				r = app.contextSetServiceIdentity(r, identity)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// servicePermissions method returns the permissions granted to the service identity by
+// -tls-service-permissions.
+func (app *application) servicePermissions(identity string) data.Permissions {
+	permissions := data.Permissions{}
+
+	for _, grant := range app.currentConfig().tls.servicePermissions {
+		// The grants were validated when the config was loaded.
+		i := strings.LastIndex(grant, "=")
+		if grant[:i] == identity {
+			permissions = append(permissions, grant[i+1:])
+		}
+	}
+
+	return permissions
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"github.com/luca0x333/go-greenlight/internal/data"
+	"github.com/luca0x333/go-greenlight/internal/validator"
+	"net/http"
+	"time"
+)
+
+// createAuthenticationTokenHandler exchanges the email address and password of a user for an
+// authentication token, valid for 24 hours. The failed logins delay and then lock out the account
+// and the client IP address, see recordFailedLogin(). The users with TOTP enabled get a two-factor
+// token instead, to exchange with a code for the authentication token, see
+// createTwoFactorAuthenticationTokenHandler().
+func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	data.ValidatePasswordPlaintext(v, input.Password)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// A delayed or locked out login is rejected without checking the password, which would
+	// otherwise still be guessable.
+	retryAfter, err := app.checkLoginAttempts(r, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if retryAfter > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
+	// An unknown email address and a wrong password get the same response, in the same time, so
+	// that the response doesn't tell whether an email address is registered.
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	match := false
+	if user != nil {
+		match, err = user.Password.Matches(input.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		data.MatchDummyPassword(input.Password)
+	}
+
+	if !match {
+		err = app.recordFailedLogin(r, input.Email, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+// completeLogin method sends a two-factor token to a user with TOTP enabled once the first
+// factor (the password or an OIDC login) has been checked, and the authentication token to the
+// other users. The failed logins of the account are kept until the second step succeeds, or
+// knowing the password would allow to guess the codes indefinitely. The deactivated users are
+// rejected.
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User) {
+	if !user.Activated {
+		app.inactiveAccountResponse(w, r)
+		return
+	}
+
+	if user.TOTPEnabled {
+		token, err := app.models.Tokens.New(r.Context(), user.ID, 5*time.Minute, data.ScopeTwoFactor)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"two_factor_token": token}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.issueAuthenticationToken(w, r, user)
+}
+
+// createTwoFactorAuthenticationTokenHandler exchanges a two-factor token and the current TOTP
+// code of the user, or one of their recovery codes, for an authentication token. The wrong codes
+// count as failed logins of the account.
+func (app *application) createTwoFactorAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TwoFactorToken string `json:"two_factor_token"`
+		Code           string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateTokenPlaintext(v, input.TwoFactorToken)
+	data.ValidateTOTPCode(v, input.Code)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopeTwoFactor, input.TwoFactorToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !user.Activated {
+		app.inactiveAccountResponse(w, r)
+		return
+	}
+
+	retryAfter, err := app.checkLoginAttempts(r, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if retryAfter > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
+	match, err := app.verifySecondFactor(r.Context(), user, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		err = app.recordFailedLogin(r, user.Email, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeTwoFactor, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.issueAuthenticationToken(w, r, user)
+}
+
+// issueAuthenticationToken method sends a new authentication token to the user once logged in,
+// and forgets the failed logins of the account. Those of the client IP address are kept, or a
+// client could guess the passwords of many accounts by logging in its own one in between.
+func (app *application) issueAuthenticationToken(w http.ResponseWriter, r *http.Request, user *data.User) {
+	err := app.models.LoginAttempts.Delete(r.Context(), data.LoginAttemptAccount, user.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 24*time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/luca0x333/go-greenlight/internal/data"
+	"github.com/luca0x333/go-greenlight/internal/totp"
+	"github.com/luca0x333/go-greenlight/internal/validator"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// totpCodeRX matches the TOTP codes, the other codes are checked as recovery codes.
+var totpCodeRX = regexp.MustCompile(`^[0-9]{6}$`)
+
+// totpSkew is the number of 30 seconds periods before and after the current one whose codes
+// are accepted.
+const totpSkew = 1
+
+// enrollTOTPHandler method starts the TOTP enrolment of the authenticated user: it generates the
+// secret, which the user adds to an authenticator app with the otpauth:// URI (usually as a QR
+// code), and stores it encrypted. TOTP is enabled once the user has confirmed a first code with
+// confirmTOTPHandler(). Starting over replaces the pending secret.
+func (app *application) enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	if user.TOTPEnabled {
+		app.totpConflictResponse(w, r, "two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TOTP.SetSecret(r.Context(), user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTOTPEnabled):
+			app.totpConflictResponse(w, r, "two-factor authentication is already enabled")
+		case errors.Is(err, data.ErrTOTPUnavailable):
+			app.totpUnavailableResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	enrolment := envelope{
+		"secret": totp.EncodeSecret(secret),
+		"uri":    totp.DefaultOptions.URI(app.currentConfig().totp.issuer, user.Email, secret),
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"totp": enrolment}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmTOTPHandler method enables TOTP for the authenticated user once the first code of the
+// authenticator app is correct, and returns the recovery codes. They are only shown this once.
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if user.TOTPEnabled {
+		app.totpConflictResponse(w, r, "two-factor authentication is already enabled")
+		return
+	}
+
+	secret, _, err := app.models.TOTP.GetSecret(r.Context(), user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.totpConflictResponse(w, r, "two-factor authentication enrolment hasn't been started")
+		case errors.Is(err, data.ErrTOTPUnavailable):
+			app.totpUnavailableResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	v := validator.New()
+
+	counter, ok := totp.DefaultOptions.Validate(secret, input.Code, time.Now(), totpSkew)
+	v.Check(ok, "code", "must be the current code of the authenticator app")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	codes, hashes, err := data.GenerateRecoveryCodes()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TOTP.Enable(r.Context(), user.ID, counter, hashes)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// disableTOTPHandler method disables TOTP for the authenticated user, who must confirm with their
+// password and a TOTP or recovery code: a stolen authentication token isn't enough. The failures
+// count as failed logins.
+func (app *application) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+
+	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateTOTPCode(v, input.Code)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !user.TOTPEnabled {
+		app.totpConflictResponse(w, r, "two-factor authentication isn't enabled")
+		return
+	}
+
+	if !app.checkSecondFactor(w, r, user, input.Password, input.Code) {
+		return
+	}
+
+	err = app.models.TOTP.Disable(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication successfully disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// regenerateRecoveryCodesHandler method replaces the recovery codes of the authenticated user,
+// e.g. once most of them have been used. The user must confirm with their password and a TOTP
+// or recovery code.
+func (app *application) regenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+
+	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateTOTPCode(v, input.Code)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !user.TOTPEnabled {
+		app.totpConflictResponse(w, r, "two-factor authentication isn't enabled")
+		return
+	}
+
+	if !app.checkSecondFactor(w, r, user, input.Password, input.Code) {
+		return
+	}
+
+	codes, hashes, err := data.GenerateRecoveryCodes()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TOTP.ReplaceRecoveryCodes(r.Context(), user.ID, hashes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkSecondFactor method checks the password and the TOTP or recovery code of the user before
+// a change of their two-factor authentication, with the same protection as the logins. It sends
+// the error response and returns false if they are wrong.
+func (app *application) checkSecondFactor(w http.ResponseWriter, r *http.Request, user *data.User, password, code string) bool {
+	retryAfter, err := app.checkLoginAttempts(r, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if retryAfter > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, retryAfter)
+		return false
+	}
+
+	match, err := user.Password.Matches(password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if match {
+		match, err = app.verifySecondFactor(r.Context(), user, code)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+	}
+
+	if !match {
+		err = app.recordFailedLogin(r, user.Email, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+
+		app.invalidCredentialsResponse(w, r)
+		return false
+	}
+
+	return true
+}
+
+// verifySecondFactor method checks the code of a user with TOTP enabled: either the current code
+// of the authenticator app, which can't be used twice, or one of the recovery codes, which is
+// then deleted.
+func (app *application) verifySecondFactor(ctx context.Context, user *data.User, code string) (bool, error) {
+	if !totpCodeRX.MatchString(code) {
+		return app.models.TOTP.UseRecoveryCode(ctx, user.ID, code)
+	}
+
+	secret, lastCounter, err := app.models.TOTP.GetSecret(ctx, user.ID)
+	if err != nil {
+		return false, err
+	}
+
+	counter, ok := totp.DefaultOptions.Validate(secret, code, time.Now(), totpSkew)
+	if !ok || counter <= lastCounter {
+		return false, nil
+	}
+
+	return app.models.TOTP.UseCounter(ctx, user.ID, counter)
+}
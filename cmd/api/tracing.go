@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"github.com/luca0x333/go-greenlight/internal/jsonlog"
+	"github.com/luca0x333/go-greenlight/internal/tracing"
+	"net/http"
+	"os"
+)
+
+// newTracer function returns the tracer for the configured exporter, or nil if tracing is disabled.
+func newTracer(cfg config, onError func(error)) (*tracing.Tracer, error) {
+	switch cfg.tracing.exporter {
+	case "none":
+		return nil, nil
+	case "stdout":
+		return tracing.New(tracing.NewWriterExporter(os.Stdout), onError), nil
+	case "otlp":
+		return tracing.New(tracing.NewOTLPExporter(cfg.tracing.endpoint, cfg.tracing.serviceName), onError), nil
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", cfg.tracing.exporter)
+	}
+}
+
+// traceRequest middleware starts the server span of the request, continuing the trace of the
+// client if the request carries a valid traceparent header, and returns the traceparent of the
+// span in the response headers.
+func (app *application) traceRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracing.Extract(r.Context(), r.Header)
+		ctx, span := tracing.Start(ctx, "HTTP "+r.Method, tracing.SpanKindServer)
+		defer span.End()
+
+		tracing.Inject(ctx, w.Header())
+
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.RequestURI())
+		span.SetAttribute("net.peer.addr", r.RemoteAddr)
+
+		// Add the trace ID to the entries logged while serving the request.
+		if sc := span.SpanContext(); sc.IsValid() {
+			ctx = jsonlog.ContextWithFields(ctx, map[string]interface{}{"trace_id": sc.TraceID.String()})
+		}
+
+		mw := newMetricsResponseWriter(w)
+		r = r.WithContext(ctx)
+
+		next.ServeHTTP(mw, r)
+
+		// The route is only known once the router has matched the request.
+		route := app.contextGetRoutePattern(r)
+		span.SetName(r.Method + " " + route)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("http.status_code", mw.statusCode)
+		span.SetAttribute("http.response_size", mw.bytes)
+
+		if mw.statusCode >= http.StatusInternalServerError {
+			span.RecordError(fmt.Errorf("%d %s", mw.statusCode, http.StatusText(mw.statusCode)))
+		}
+	})
+}
+
+// traceMiddleware wraps a middleware of the chain (and everything it calls) in its own span,
+// so that the time spent in each layer is visible in the trace.
+func (app *application) traceMiddleware(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracing.Start(r.Context(), "middleware "+name, tracing.SpanKindInternal)
+		defer span.End()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"github.com/luca0x333/go-greenlight/internal/data"
 	"github.com/luca0x333/go-greenlight/internal/validator"
 	"net/http"
+	"strings"
+	"time"
 )
 
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -22,11 +25,12 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Copy the data from the request body into a new User struct.
+	// Copy the data from the request body into a new User struct. The email address isn't
+	// verified until the user confirms a change of address or logs in with the OIDC provider.
 	user := &data.User{
 		Name:      input.Name,
 		Email:     input.Email,
-		Activated: false,
+		Activated: true,
 	}
 
 	// Use Set method to generate and store the hashed and plaintext password into the struct.
@@ -44,11 +48,220 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// Insert the user data into the database.
-	err = app.models.Users.Insert(user)
+	// A duplicate email address is reported by the database as a constraint violation on the
+	// "email" field which constraintErrorResponse() sends as a 422 response.
+	err = app.models.Users.Insert(r.Context(), user)
+	if err != nil {
+		app.constraintErrorResponse(w, r, v, err)
+		return
+	}
+
+	// The new users can read the movies, the other permissions are granted by an operator.
+	err = app.models.Permissions.AddForUser(r.Context(), user.ID, data.PermissionMoviesRead)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Use the background helper to execute an anonymous function that sends the welcome email.
+	app.background(func() {
+		err := app.mailer.Send(r.Context(), user.Email, "user_welcome.tmpl", user)
+		if err != nil {
+			// We use PrintErrorCtx because by the time we encounter the errors,
+			// the client will probably have already been sent a 202 Accepted response by our writeJSON() helper.
+			app.logger.PrintErrorCtx(r.Context(), err, nil)
+		}
+	})
+
+	// Write a JSON response with 202 StatusAccepted status code.
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showCurrentUserHandler method returns the authenticated user.
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"user": app.contextGetUser(r)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateCurrentUserHandler method updates the name and the password of the authenticated user.
+// Changing the password requires the current one. The email address is changed with
+// requestEmailChangeHandler(), once the new address is confirmed.
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	// Name and Password are pointers so that a missing field leaves the record unchanged.
+	var input struct {
+		Name            *string `json:"name"`
+		Password        *string `json:"password"`
+		CurrentPassword string  `json:"current_password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if input.Password != nil {
+		v := validator.New()
+		v.Check(input.CurrentPassword != "", "current_password", "must be provided to change the password")
+
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		if !app.checkPassword(w, r, user, input.CurrentPassword) {
+			return
+		}
+
+		err = user.Password.Set(*input.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+
+	v := validator.New()
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The update is rejected if the user has changed since the request was authenticated. A new
+	// password logs out the other sessions and revokes the API keys, which may have been created
+	// by whoever knew the previous one, in the same transaction.
+	err = app.models.Transaction(r.Context(), func(tx data.Models) error {
+		err := tx.Users.Update(r.Context(), user)
+		if err != nil || input.Password == nil {
+			return err
+		}
+
+		return revokeOtherSessions(r.Context(), tx, user.ID, currentToken(r))
+	})
 	if err != nil {
 		switch {
-		case errors.Is(err, data.ErrDuplicateEmail):
-			v.AddError("email", "a user with this email address already exists")
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.constraintErrorResponse(w, r, v, err)
+		}
+		return
+	}
+
+	if input.Password != nil {
+		app.logger.PrintInfoCtx(r.Context(), "password changed", map[string]interface{}{"user_id": user.ID})
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// requestEmailChangeHandler method starts the change of the email address of the authenticated
+// user, which requires their password: a token is sent to the new address, and the address is
+// only changed when the user confirms it with confirmEmailChangeHandler().
+func (app *application) requestEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	v.Check(!strings.EqualFold(input.Email, user.Email), "email", "must be different from the current email address")
+	v.Check(input.Password != "", "password", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.checkPassword(w, r, user, input.Password) {
+		return
+	}
+
+	// The address is checked again when the change is confirmed, in case it has been taken
+	// in between.
+	_, err = app.models.Users.GetByEmail(r.Context(), input.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	change, err := app.models.EmailChanges.New(r.Context(), user.ID, input.Email, 24*time.Hour)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		err := app.mailer.Send(r.Context(), change.Email, "email_change.tmpl", map[string]interface{}{
+			"Name":  user.Name,
+			"Token": change.Token.Plaintext,
+		})
+		if err != nil {
+			app.logger.PrintErrorCtx(r.Context(), err, nil)
+		}
+	})
+
+	message := "an email will be sent to the new address containing the instructions to confirm it"
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": message}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmEmailChangeHandler method changes the email address of a user with the token sent to the
+// new address by requestEmailChangeHandler(), and notifies the previous address.
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	change, err := app.models.EmailChanges.GetForToken(r.Context(), input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -56,19 +269,200 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Use the background helper to execute an anonymous function that sends the welcome email.
+	user, err := app.models.Users.Get(r.Context(), change.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	previousEmail := user.Email
+	user.Email = change.Email
+	user.EmailVerified = true
+
+	// A violation of the "users_email_key" constraint is sent as a 422 response on the "email"
+	// field by constraintErrorResponse().
+	err = app.models.Users.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.constraintErrorResponse(w, r, v, err)
+		}
+		return
+	}
+
+	err = app.models.EmailChanges.DeleteForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfoCtx(r.Context(), "email address changed", map[string]interface{}{"user_id": user.ID})
+
 	app.background(func() {
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", user)
+		err := app.mailer.Send(r.Context(), previousEmail, "email_changed.tmpl", user)
 		if err != nil {
-			// We use PrintError because by the time we encounter the errors,
-			// the client will probably have already been sent a 202 Accepted response by our writeJSON() helper.
-			app.logger.PrintError(err, nil)
+			app.logger.PrintErrorCtx(r.Context(), err, nil)
 		}
 	})
 
-	// Write a JSON response with 202 StatusAccepted status code.
-	err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateUserPasswordHandler method sets the new password of a user with the token sent when an
+// administrator has reset their password, see resetUserPasswordHandler().
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopePasswordReset, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = user.Password.Set(input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopePasswordReset, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfoCtx(r.Context(), "password changed", map[string]interface{}{"user_id": user.ID})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "your password was successfully reset"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkPassword method checks the password of the authenticated user before a change of their
+// credentials, with the same protection as the logins, so that a stolen token can't be used to
+// guess the password. It sends the error response and returns false if the password is wrong.
+func (app *application) checkPassword(w http.ResponseWriter, r *http.Request, user *data.User, password string) bool {
+	retryAfter, err := app.checkLoginAttempts(r, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if retryAfter > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, retryAfter)
+		return false
+	}
+
+	match, err := user.Password.Matches(password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !match {
+		err = app.recordFailedLogin(r, user.Email, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+
+		app.invalidCredentialsResponse(w, r)
+		return false
+	}
+
+	return true
+}
+
+// deleteUserTokens function deletes the tokens of all the scopes of the user, in the transaction.
+func deleteUserTokens(ctx context.Context, tx data.Models, userID int64) error {
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeTwoFactor, data.ScopePasswordReset} {
+		err := tx.Tokens.DeleteAllForUser(ctx, scope, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// revokeOtherSessions function deletes the tokens of the user, except the authentication token
+// tokenPlaintext, and the API keys, in the transaction.
+func revokeOtherSessions(ctx context.Context, tx data.Models, userID int64, tokenPlaintext string) error {
+	err := tx.Tokens.DeleteAllForUserExcept(ctx, data.ScopeAuthentication, userID, tokenPlaintext)
+	if err != nil {
+		return err
 	}
+
+	for _, scope := range []string{data.ScopeTwoFactor, data.ScopePasswordReset} {
+		err = tx.Tokens.DeleteAllForUser(ctx, scope, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.APIKeys.DeleteAllForUser(ctx, userID)
+}
+
+// currentToken function returns the authentication token of the request. requireUserToken() only
+// lets through the requests authenticated with a "Bearer <token>" header.
+func currentToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// revokeUserAccess function deletes the tokens, the API keys and the pending email change of the
+// user, in the transaction.
+func revokeUserAccess(ctx context.Context, tx data.Models, userID int64) error {
+	err := deleteUserTokens(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+
+	err = tx.APIKeys.DeleteAllForUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.EmailChanges.DeleteForUser(ctx, userID)
 }
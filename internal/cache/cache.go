@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Item struct holds a cached value and the time at which it was stored.
+// Values are stored as bytes so that the Cache interface can be implemented by external caches.
+type Item struct {
+	Value    []byte
+	StoredAt time.Time
+}
+
+// Age returns how long ago the item was stored.
+func (i Item) Age() time.Duration {
+	return time.Since(i.StoredAt)
+}
+
+// Cache interface is implemented by every cache backend. The in-process LRU is the default
+// implementation, an external cache (e.g. Redis or Memcached) only needs these four methods.
+type Cache interface {
+	// Get returns the item stored under key, the boolean is false if there is no such
+	// item or if it has expired.
+	Get(key string) (Item, bool)
+	// Set stores value under key for the ttl duration.
+	Set(key string, value []byte, ttl time.Duration)
+	// Delete removes the item stored under key, if any.
+	Delete(key string)
+	// DeletePrefix removes all the items whose key starts with prefix.
+	DeletePrefix(prefix string)
+}
+
+// Stats struct holds the counters of a cache. The fields are updated atomically, use
+// Snapshot() to read them.
+type Stats struct {
+	hits      int64
+	misses    int64
+	shared    int64
+	evictions int64
+}
+
+// StatsSnapshot struct holds a point in time copy of the Stats counters.
+// Shared is the number of loads which were served by an identical in-flight load.
+type StatsSnapshot struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Shared    int64 `json:"shared"`
+	Evictions int64 `json:"evictions"`
+}
+
+func (s *Stats) Hit()      { atomic.AddInt64(&s.hits, 1) }
+func (s *Stats) Miss()     { atomic.AddInt64(&s.misses, 1) }
+func (s *Stats) Shared()   { atomic.AddInt64(&s.shared, 1) }
+func (s *Stats) Eviction() { atomic.AddInt64(&s.evictions, 1) }
+
+// Snapshot returns a copy of the counters.
+func (s *Stats) Snapshot() StatsSnapshot {
+	return StatsSnapshot{
+		Hits:      atomic.LoadInt64(&s.hits),
+		Misses:    atomic.LoadInt64(&s.misses),
+		Shared:    atomic.LoadInt64(&s.shared),
+		Evictions: atomic.LoadInt64(&s.evictions),
+	}
+}
@@ -0,0 +1,124 @@
+package cache
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+// entry struct is the value stored in the elements of the LRU list.
+type entry struct {
+	key       string
+	item      Item
+	expiresAt time.Time
+}
+
+// LRU struct is an in-process, size bounded cache. When it is full the least recently used
+// item is evicted, and items are never returned after their ttl has expired.
+type LRU struct {
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+	stats    *Stats
+	mu       sync.Mutex
+}
+
+// NewLRU function returns a new LRU holding at most capacity items. Evictions are recorded in
+// stats, which can be nil.
+func NewLRU(capacity int, stats *Stats) *LRU {
+	if stats == nil {
+		stats = &Stats{}
+	}
+
+	return &LRU{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		stats:    stats,
+	}
+}
+
+// Get returns the item stored under key and marks it as the most recently used.
+// Expired items are removed lazily when they are read.
+func (c *LRU) Get(key string) (Item, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, found := c.items[key]
+	if !found {
+		return Item{}, false
+	}
+
+	e := el.Value.(*entry)
+	if time.Now().After(e.expiresAt) {
+		c.remove(el)
+		return Item{}, false
+	}
+
+	c.ll.MoveToFront(el)
+
+	return e.item, true
+}
+
+// Set stores value under key, evicting the least recently used item if the cache is full.
+func (c *LRU) Set(key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	e := &entry{
+		key:       key,
+		item:      Item{Value: value, StoredAt: now},
+		expiresAt: now.Add(ttl),
+	}
+
+	if el, found := c.items[key]; found {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(e)
+
+	for c.capacity > 0 && c.ll.Len() > c.capacity {
+		c.remove(c.ll.Back())
+		c.stats.Eviction()
+	}
+}
+
+// Delete removes the item stored under key.
+func (c *LRU) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, found := c.items[key]; found {
+		c.remove(el)
+	}
+}
+
+// DeletePrefix removes all the items whose key starts with prefix.
+func (c *LRU) DeletePrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, el := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(el)
+		}
+	}
+}
+
+// Len returns the number of items in the cache, including the expired ones not read yet.
+func (c *LRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ll.Len()
+}
+
+// remove must be called with the mutex held.
+func (c *LRU) remove(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*entry).key)
+}
@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+)
+
+// errLoadPanicked is returned to the waiting callers if the function of the load panicked.
+var errLoadPanicked = errors.New("cache: load panicked")
+
+// call struct holds an in-flight or completed Group.Do() call.
+type call struct {
+	wg    sync.WaitGroup
+	value []byte
+	err   error
+}
+
+// Group struct deduplicates concurrent loads of the same key: while a load is in flight, every
+// other caller asking for the same key waits for it and shares its result instead of hitting
+// the database. This protects the database against a cache stampede when a popular key expires.
+type Group struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// Do executes fn for key, making sure only one execution is in flight at a time for a given key.
+// The shared boolean is true for the callers which received the result of another caller's fn.
+func (g *Group) Do(key string, fn func() ([]byte, error)) (value []byte, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+
+	if c, found := g.calls[key]; found {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.value, c.err, true
+	}
+
+	c := &call{err: errLoadPanicked}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	// Make sure the waiting callers are released and the key is forgotten even if fn panics.
+	defer func() {
+		c.wg.Done()
+
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+	}()
+
+	c.value, c.err = fn()
+
+	return c.value, c.err, false
+}
@@ -0,0 +1,130 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Actions of the administrators on the user accounts.
+const (
+	AdminActionActivate         = "activate"
+	AdminActionDeactivate       = "deactivate"
+	AdminActionResetPassword    = "reset_password"
+	AdminActionGrantPermission  = "grant_permission"
+	AdminActionRevokePermission = "revoke_permission"
+	AdminActionDelete           = "delete"
+)
+
+// AdminAction struct records an action of an administrator on a user account. ActorID is nil
+// once the administrator's account has been deleted, the actions on a deleted user are kept.
+type AdminAction struct {
+	ID        int64                  `json:"id"`
+	CreatedAt time.Time              `json:"created_at"`
+	ActorID   *int64                 `json:"actor_id"`
+	UserID    int64                  `json:"user_id"`
+	Action    string                 `json:"action"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// AdminActionModel struct wraps the connection pool, or a transaction of Models.Transaction().
+type AdminActionModel struct {
+	DB DBTX
+}
+
+// Insert method records the action.
+func (m AdminActionModel) Insert(ctx context.Context, action *AdminAction) error {
+	ctx, span := startSpan(ctx, "admin_actions.insert")
+	defer span.End()
+
+	// A nil map would be encoded as null.
+	details := []byte("{}")
+
+	if action.Details != nil {
+		var err error
+
+		details, err = json.Marshal(action.Details)
+		if err != nil {
+			return err
+		}
+	}
+
+	query := `
+		INSERT INTO admin_actions (actor_id, user_id, action, details)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`
+
+	args := []interface{}{action.ActorID, action.UserID, action.Action, string(details)}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&action.ID, &action.CreatedAt)
+	if err != nil {
+		span.RecordError(err)
+		return translateError(err)
+	}
+
+	span.SetAttribute("db.rows_affected", 1)
+
+	return nil
+}
+
+// GetAll method returns a page of the recorded actions, the most recent first, on the user or
+// on all the users if userID is 0, with the pagination metadata.
+func (m AdminActionModel) GetAll(ctx context.Context, userID int64, filters Filters) ([]*AdminAction, Metadata, error) {
+	ctx, span := startSpan(ctx, "admin_actions.get_all")
+	defer span.End()
+
+	query := `
+		SELECT count(*) OVER(), id, created_at, actor_id, user_id, action, details
+		FROM admin_actions
+		WHERE ($1 = 0 OR user_id = $1)
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, filters.limit(), filters.offset())
+	if err != nil {
+		span.RecordError(err)
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	actions := []*AdminAction{}
+
+	for rows.Next() {
+		var (
+			action  AdminAction
+			details []byte
+		)
+
+		err := rows.Scan(&totalRecords, &action.ID, &action.CreatedAt, &action.ActorID, &action.UserID, &action.Action, &details)
+		if err != nil {
+			span.RecordError(err)
+			return nil, Metadata{}, err
+		}
+
+		err = json.Unmarshal(details, &action.Details)
+		if err != nil {
+			span.RecordError(err)
+			return nil, Metadata{}, err
+		}
+
+		actions = append(actions, &action)
+	}
+
+	if err = rows.Err(); err != nil {
+		span.RecordError(err)
+		return nil, Metadata{}, err
+	}
+
+	span.SetAttribute("db.rows", len(actions))
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return actions, metadata, nil
+}
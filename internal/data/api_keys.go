@@ -0,0 +1,299 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"github.com/lib/pq"
+	"github.com/luca0x333/go-greenlight/internal/validator"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// APIKeyRX matches the API keys: "gl_", the prefix identifying the key (8 characters) then the
+// secret (32 characters), e.g. gl_3kq7x2ma_....
+var APIKeyRX = regexp.MustCompile(`^gl_[a-z2-7]{8}_[a-z2-7]{32}$`)
+
+// APIKey struct holds the data of an API key, which authenticates a machine client as its owner
+// with a subset of the owner's permissions. As for the tokens, only the SHA-256 hash of the key
+// is stored and the plaintext is sent once when the key is created. The prefix is stored in
+// plaintext to identify the key, e.g. in the logs. A nil Expiry means that the key doesn't expire.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Prefix      string      `json:"prefix"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	Expiry      *time.Time  `json:"expiry,omitempty"`
+	LastUsedAt  *time.Time  `json:"last_used_at,omitempty"`
+}
+
+// apiKeyEncoding is the lowercase base32 encoding of the API keys, without padding.
+var apiKeyEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// GenerateAPIKey function returns a new API key of the user, with the plaintext and its hash set.
+// The prefix is 5 random bytes and the secret 20 random bytes, both encoded in base32.
+func GenerateAPIKey(userID int64, name string, permissions Permissions, expiry *time.Time) (*APIKey, error) {
+	randomBytes := make([]byte, 25)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &APIKey{
+		UserID:      userID,
+		Name:        name,
+		Prefix:      apiKeyEncoding.EncodeToString(randomBytes[:5]),
+		Permissions: permissions,
+		Expiry:      expiry,
+	}
+
+	key.Plaintext = "gl_" + key.Prefix + "_" + apiKeyEncoding.EncodeToString(randomBytes[5:])
+
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	return key, nil
+}
+
+func ValidateAPIKeyPlaintext(v *validator.Validator, plaintext string) {
+	v.Check(plaintext != "", "key", "must be provided")
+	v.Check(APIKeyRX.MatchString(plaintext), "key", "must be a valid API key")
+}
+
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(strings.TrimSpace(key.Name) != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(key.Permissions) > 0, "permissions", "must contain at least one permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+	v.Check(key.Expiry == nil || key.Expiry.After(time.Now()), "expiry", "must be in the future")
+}
+
+// APIKeyModel struct wraps the connection pool, or a transaction of Models.Transaction().
+type APIKeyModel struct {
+	DB DBTX
+}
+
+// Insert method inserts the API key into the database.
+func (m APIKeyModel) Insert(ctx context.Context, key *APIKey) error {
+	ctx, span := startSpan(ctx, "api_keys.insert")
+	defer span.End()
+
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, hash, permissions, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+
+	args := []interface{}{key.UserID, key.Name, key.Prefix, key.Hash, pq.Array(key.Permissions), key.Expiry}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		span.RecordError(err)
+		return translateError(err)
+	}
+
+	span.SetAttribute("db.rows_affected", 1)
+
+	return nil
+}
+
+// GetAllForUser method returns the API keys of the user, the most recent first.
+func (m APIKeyModel) GetAllForUser(ctx context.Context, userID int64) ([]*APIKey, error) {
+	ctx, span := startSpan(ctx, "api_keys.get_all_for_user")
+	defer span.End()
+
+	query := `
+		SELECT id, created_at, user_id, name, prefix, permissions, expiry, last_used_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY id DESC`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		var key APIKey
+
+		err := rows.Scan(
+			&key.ID,
+			&key.CreatedAt,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			pq.Array(&key.Permissions),
+			&key.Expiry,
+			&key.LastUsedAt,
+		)
+		if err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	span.SetAttribute("db.rows", len(keys))
+
+	return keys, nil
+}
+
+// GetForKey method returns the API key matching the plaintext, if it hasn't expired, and its
+// owner. It also records that the key has been used, at most once a minute to limit the writes.
+func (m APIKeyModel) GetForKey(ctx context.Context, plaintext string) (*APIKey, *User, error) {
+	ctx, span := startSpan(ctx, "api_keys.get_for_key")
+	defer span.End()
+
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		SELECT api_keys.id, api_keys.created_at, api_keys.user_id, api_keys.name, api_keys.prefix,
+			api_keys.permissions, api_keys.expiry, api_keys.last_used_at,
+			users.id, users.created_at, users.name, users.email, users.password_hash, users.activated,
+			users.email_verified, users.totp_enabled, users.version
+		FROM api_keys
+		INNER JOIN users ON users.id = api_keys.user_id
+		WHERE api_keys.hash = $1
+		AND (api_keys.expiry IS NULL OR api_keys.expiry > $2)`
+
+	var (
+		key  APIKey
+		user User
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], time.Now()).Scan(
+		&key.ID,
+		&key.CreatedAt,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		pq.Array(&key.Permissions),
+		&key.Expiry,
+		&key.LastUsedAt,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.EmailVerified,
+		&user.TOTPEnabled,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			span.SetAttribute("db.rows", 0)
+			return nil, nil, ErrRecordNotFound
+		default:
+			span.RecordError(err)
+			return nil, nil, err
+		}
+	}
+
+	span.SetAttribute("db.rows", 1)
+
+	query = `
+		UPDATE api_keys
+		SET last_used_at = NOW()
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`
+
+	_, err = m.DB.ExecContext(ctx, query, key.ID)
+	if err != nil {
+		span.RecordError(err)
+		return nil, nil, err
+	}
+
+	return &key, &user, nil
+}
+
+// Delete method deletes the API key of the user. It returns ErrRecordNotFound if the user has
+// no such key.
+func (m APIKeyModel) Delete(ctx context.Context, id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, span := startSpan(ctx, "api_keys.delete")
+	defer span.End()
+
+	query := `
+		DELETE FROM api_keys
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	span.SetAttribute("db.rows_affected", rowsAffected)
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteAllForUser method deletes all the API keys of the user.
+func (m APIKeyModel) DeleteAllForUser(ctx context.Context, userID int64) error {
+	ctx, span := startSpan(ctx, "api_keys.delete_all_for_user")
+	defer span.End()
+
+	query := `
+		DELETE FROM api_keys
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err == nil {
+		span.SetAttribute("db.rows_affected", rowsAffected)
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"github.com/luca0x333/go-greenlight/internal/cache"
+	"github.com/luca0x333/go-greenlight/internal/tracing"
+	"sync/atomic"
+	"time"
+)
+
+// CacheInfo struct describes how a cached read was served. Hit is true when the data came from
+// the cache, Age is how old the data is and TTL how long it is kept for. The zero value means
+// that caching is disabled.
+type CacheInfo struct {
+	Hit bool
+	Age time.Duration
+	TTL time.Duration
+}
+
+// cacheLoadTimeout is the timeout of a load shared by concurrent cache misses.
+const cacheLoadTimeout = 5 * time.Second
+
+// detachedContext struct is a context carrying the values of its parent, without its deadline
+// and cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (c detachedContext) Done() <-chan struct{}             { return nil }
+func (c detachedContext) Err() error                        { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// readCache struct is the read-through cache put in front of the model reads.
+// Values are gob encoded (rather than JSON encoded) so that the fields hidden from the
+// API responses, like Movie.CreatedAt, survive the round trip.
+type readCache struct {
+	// generation is incremented on every invalidation. A load which started before an
+	// invalidation doesn't store its (possibly stale) result. It is kept as the first
+	// field to guarantee the 64-bit alignment required by the atomic operations.
+	generation int64
+	store      cache.Cache
+	ttl        time.Duration
+	group      cache.Group
+	stats      *cache.Stats
+}
+
+func newReadCache(store cache.Cache, ttl time.Duration, stats *cache.Stats) *readCache {
+	if stats == nil {
+		stats = &cache.Stats{}
+	}
+
+	return &readCache{
+		store: store,
+		ttl:   ttl,
+		stats: stats,
+	}
+}
+
+// load decodes the value stored under key into dst. On a miss fn is called to load the value
+// from the database, concurrent misses for the same key share a single call to fn.
+func (c *readCache) load(ctx context.Context, key string, dst interface{}, fn func(context.Context) (interface{}, error)) (CacheInfo, error) {
+	ctx, span := tracing.Start(ctx, "cache.load", tracing.SpanKindInternal)
+	defer span.End()
+
+	if item, found := c.store.Get(key); found {
+		c.stats.Hit()
+		span.SetAttribute("cache.hit", true)
+		return CacheInfo{Hit: true, Age: item.Age(), TTL: c.ttl}, gob.NewDecoder(bytes.NewReader(item.Value)).Decode(dst)
+	}
+
+	c.stats.Miss()
+	span.SetAttribute("cache.hit", false)
+
+	value, err, shared := c.group.Do(key, func() ([]byte, error) {
+		generation := atomic.LoadInt64(&c.generation)
+
+		// The result is shared with the concurrent callers, so the load must not be canceled
+		// with the request of the first one. It keeps the values of its context (the trace
+		// span, the request ID etc.) but has its own timeout.
+		loadCtx, cancel := context.WithTimeout(detachedContext{ctx}, cacheLoadTimeout)
+		defer cancel()
+
+		v, err := fn(loadCtx)
+		if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		err = gob.NewEncoder(&buf).Encode(v)
+		if err != nil {
+			return nil, err
+		}
+
+		if generation == atomic.LoadInt64(&c.generation) {
+			c.store.Set(key, buf.Bytes(), c.ttl)
+		}
+
+		return buf.Bytes(), nil
+	})
+	if shared {
+		c.stats.Shared()
+		span.SetAttribute("cache.shared", true)
+	}
+	if err != nil {
+		return CacheInfo{}, err
+	}
+
+	return CacheInfo{TTL: c.ttl}, gob.NewDecoder(bytes.NewReader(value)).Decode(dst)
+}
+
+// invalidate removes the given keys and all the keys starting with one of the prefixes.
+func (c *readCache) invalidate(keys []string, prefixes []string) {
+	atomic.AddInt64(&c.generation, 1)
+
+	for _, key := range keys {
+		c.store.Delete(key)
+	}
+
+	for _, prefix := range prefixes {
+		c.store.DeletePrefix(prefix)
+	}
+}
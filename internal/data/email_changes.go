@@ -0,0 +1,117 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ScopeEmailChange is the scope of the tokens confirming a change of email address. They are
+// stored with the new address in the email_changes table rather than in the tokens table.
+const ScopeEmailChange = "email-change"
+
+// EmailChange struct holds a pending change of the email address of a user, until the user
+// confirms it with the token sent to the new address. A user has at most one pending change.
+type EmailChange struct {
+	UserID int64
+	Email  string
+	Token  *Token
+}
+
+// EmailChangeModel struct wraps the connection pool, or a transaction of Models.Transaction().
+type EmailChangeModel struct {
+	DB DBTX
+}
+
+// New method generates the token confirming the change of the email address of the user, valid
+// for ttl, and stores the pending change. It replaces the previous pending change of the user.
+func (m EmailChangeModel) New(ctx context.Context, userID int64, email string, ttl time.Duration) (*EmailChange, error) {
+	token, err := generateToken(userID, ttl, ScopeEmailChange)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, span := startSpan(ctx, "email_changes.insert")
+	defer span.End()
+
+	query := `
+		INSERT INTO email_changes (user_id, hash, email, expiry)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE
+		SET hash = EXCLUDED.hash, email = EXCLUDED.email, expiry = EXCLUDED.expiry`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, userID, token.Hash, email, token.Expiry)
+	if err != nil {
+		span.RecordError(err)
+		return nil, translateError(err)
+	}
+
+	span.SetAttribute("db.rows_affected", 1)
+
+	return &EmailChange{UserID: userID, Email: email, Token: token}, nil
+}
+
+// GetForToken method returns the pending change confirmed by the token, if it hasn't expired.
+func (m EmailChangeModel) GetForToken(ctx context.Context, tokenPlaintext string) (*EmailChange, error) {
+	ctx, span := startSpan(ctx, "email_changes.get_for_token")
+	defer span.End()
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		SELECT user_id, email
+		FROM email_changes
+		WHERE hash = $1 AND expiry > $2`
+
+	var change EmailChange
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], time.Now()).Scan(&change.UserID, &change.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			span.SetAttribute("db.rows", 0)
+			return nil, ErrRecordNotFound
+		default:
+			span.RecordError(err)
+			return nil, err
+		}
+	}
+
+	span.SetAttribute("db.rows", 1)
+
+	return &change, nil
+}
+
+// DeleteForUser method deletes the pending change of the user, if any.
+func (m EmailChangeModel) DeleteForUser(ctx context.Context, userID int64) error {
+	ctx, span := startSpan(ctx, "email_changes.delete_for_user")
+	defer span.End()
+
+	query := `
+		DELETE FROM email_changes
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err == nil {
+		span.SetAttribute("db.rows_affected", rowsAffected)
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+)
+
+// PostgreSQL error codes that we translate into domain errors.
+// See https://www.postgresql.org/docs/current/errcodes-appendix.html for the full list.
+const (
+	pgNotNullViolation     = "23502"
+	pgForeignKeyViolation  = "23503"
+	pgUniqueViolation      = "23505"
+	pgCheckViolation       = "23514"
+	pgSerializationFailure = "40001"
+)
+
+// Domain errors returned (wrapped in a ConstraintError) when a statement violates one of
+// the database constraints. Callers can test for them with errors.Is().
+var (
+	ErrUniqueViolation      = errors.New("unique constraint violation")
+	ErrCheckViolation       = errors.New("check constraint violation")
+	ErrForeignKeyViolation  = errors.New("foreign key constraint violation")
+	ErrNotNullViolation     = errors.New("not null constraint violation")
+	ErrSerializationFailure = errors.New("serialization failure")
+)
+
+// constraint struct describes how a named database constraint maps onto the API.
+// field is the JSON key of the offending input, message is the client facing
+// message and err is an optional legacy sentinel error that the violation should also match.
+type constraint struct {
+	field   string
+	message string
+	err     error
+}
+
+// constraints holds the known constraint names declared in the migrations.
+var constraints = map[string]constraint{
+	"users_email_key":      {field: "email", message: "a user with this email address already exists", err: ErrDuplicateEmail},
+	"movies_year_check":    {field: "year", message: "must be between 1888 and the current year"},
+	"movies_runtime_check": {field: "runtime", message: "must not be negative"},
+	"genres_length_check":  {field: "genres", message: "must contain between 1 and 5 genres"},
+}
+
+// ConstraintError is returned by the models when the database rejects a statement.
+// Kind is one of the Err*Violation / ErrSerializationFailure sentinel errors, Field and Message
+// describe the offending input (Field is empty if it cannot be determined) and Err holds the
+// original *pq.Error.
+type ConstraintError struct {
+	Kind       error
+	Constraint string
+	Field      string
+	Message    string
+	Err        error
+}
+
+func (e *ConstraintError) Error() string {
+	if e.Constraint != "" {
+		return fmt.Sprintf("%s: %s", e.Kind, e.Constraint)
+	}
+
+	return e.Kind.Error()
+}
+
+// Unwrap returns the underlying *pq.Error so that errors.As() still works on it.
+func (e *ConstraintError) Unwrap() error {
+	return e.Err
+}
+
+// Is allows errors.Is() to match both the violation kind and the legacy sentinel error
+// associated with the constraint (e.g. ErrDuplicateEmail for "users_email_key").
+func (e *ConstraintError) Is(target error) bool {
+	if target == e.Kind {
+		return true
+	}
+
+	c, ok := constraints[e.Constraint]
+	return ok && c.err != nil && target == c.err
+}
+
+// translateError inspects err and, if it is a *pq.Error with one of the codes we care about,
+// returns a *ConstraintError carrying the offending field. Any other error is returned unchanged.
+func translateError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+
+	ce := &ConstraintError{
+		Constraint: pqErr.Constraint,
+		Err:        err,
+	}
+
+	switch pqErr.Code {
+	case pgUniqueViolation:
+		ce.Kind = ErrUniqueViolation
+		ce.Message = "must be unique"
+	case pgCheckViolation:
+		ce.Kind = ErrCheckViolation
+		ce.Message = "is invalid"
+	case pgForeignKeyViolation:
+		ce.Kind = ErrForeignKeyViolation
+		ce.Message = "references a record that does not exist"
+	case pgNotNullViolation:
+		// For NOT NULL violations Postgres reports the column instead of a constraint name.
+		ce.Kind = ErrNotNullViolation
+		ce.Field = pqErr.Column
+		ce.Message = "must be provided"
+	case pgSerializationFailure:
+		ce.Kind = ErrSerializationFailure
+		return ce
+	default:
+		return err
+	}
+
+	// Override the generic field and message if we know about this constraint.
+	if c, ok := constraints[pqErr.Constraint]; ok {
+		ce.Field = c.field
+		ce.Message = c.message
+	}
+
+	return ce
+}
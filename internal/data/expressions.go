@@ -0,0 +1,256 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/luca0x333/go-greenlight/internal/validator"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Operator custom type represents the comparison applied by a filter condition.
+type Operator string
+
+const (
+	OpEq  Operator = "eq"  // field = value
+	OpNe  Operator = "ne"  // field <> value
+	OpGt  Operator = "gt"  // field > value
+	OpGte Operator = "gte" // field >= value
+	OpLt  Operator = "lt"  // field < value
+	OpLte Operator = "lte" // field <= value
+	OpIn  Operator = "in"  // field is one of the comma separated values
+	OpAny Operator = "any" // array field overlaps the comma separated values
+	OpAll Operator = "all" // array field contains all the comma separated values
+)
+
+// sqlOperators maps the scalar operators to their SQL counterpart.
+var sqlOperators = map[Operator]string{
+	OpEq:  "=",
+	OpNe:  "<>",
+	OpGt:  ">",
+	OpGte: ">=",
+	OpLt:  "<",
+	OpLte: "<=",
+}
+
+// fieldKind custom type defines how the values of a filterable field are parsed.
+type fieldKind int
+
+const (
+	intField fieldKind = iota
+	timeField
+	textArrayField
+)
+
+// filterField describes a column which can be filtered on and the operators it supports.
+// The column name is the only identifier written into the SQL, and it never comes from user input.
+type filterField struct {
+	column    string
+	kind      fieldKind
+	operators []Operator
+}
+
+var (
+	scalarOperators  = []Operator{OpEq, OpNe, OpGt, OpGte, OpLt, OpLte}
+	numericOperators = []Operator{OpEq, OpNe, OpGt, OpGte, OpLt, OpLte, OpIn}
+	arrayOperators   = []Operator{OpAny, OpAll}
+)
+
+// movieFilterFields holds the fields which can be used in a filter expression on GET /v1/movies.
+var movieFilterFields = map[string]filterField{
+	"id":         {column: "id", kind: intField, operators: numericOperators},
+	"year":       {column: "year", kind: intField, operators: numericOperators},
+	"runtime":    {column: "runtime", kind: intField, operators: numericOperators},
+	"created_at": {column: "created_at", kind: timeField, operators: scalarOperators},
+	"genres":     {column: "genres", kind: textArrayField, operators: arrayOperators},
+}
+
+// filterKeyRX matches the query string keys in the format field[operator].
+var filterKeyRX = regexp.MustCompile(`^([a-z_]+)\[([a-z]+)\]$`)
+
+// Condition struct is a single node of a filter expression, e.g. year[gte]=1990.
+// Value holds the parsed value: an int64, a time.Time, or a slice of them for the list operators.
+type Condition struct {
+	Field    string
+	Operator Operator
+	Value    interface{}
+	column   string
+}
+
+// FilterExpr struct holds the conditions of a filter expression, which are ANDed together.
+type FilterExpr struct {
+	Conditions []Condition
+}
+
+// ParseMovieFilterExpr parses the field[operator]=value query string parameters of a movies
+// listing request. Any problem is recorded in the validator under the offending key.
+func ParseMovieFilterExpr(v *validator.Validator, qs url.Values) FilterExpr {
+	return parseFilterExpr(v, qs, movieFilterFields)
+}
+
+// parseFilterExpr builds a FilterExpr from the query string keys in the format field[operator].
+// Keys without brackets are ignored as they are handled by the callers.
+func parseFilterExpr(v *validator.Validator, qs url.Values, fields map[string]filterField) FilterExpr {
+	var expr FilterExpr
+
+	// Sort the keys so that the generated SQL (and its placeholders) is deterministic.
+	keys := make([]string, 0, len(qs))
+	for key := range qs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !strings.Contains(key, "[") {
+			continue
+		}
+
+		matches := filterKeyRX.FindStringSubmatch(key)
+		if matches == nil {
+			v.AddError(key, "invalid filter, must be in the format field[operator]")
+			continue
+		}
+
+		field, found := fields[matches[1]]
+		if !found {
+			v.AddError(key, "unknown filter field")
+			continue
+		}
+
+		op := Operator(matches[2])
+		if !operatorIn(op, field.operators) {
+			v.AddError(key, fmt.Sprintf("unsupported operator for field %s", matches[1]))
+			continue
+		}
+
+		value, err := field.parse(op, qs.Get(key))
+		if err != nil {
+			v.AddError(key, err.Error())
+			continue
+		}
+
+		expr.Conditions = append(expr.Conditions, Condition{
+			Field:    matches[1],
+			Operator: op,
+			Value:    value,
+			column:   field.column,
+		})
+	}
+
+	v.Check(len(expr.Conditions) <= 20, "filters", "must not contain more than 20 conditions")
+
+	return expr
+}
+
+func operatorIn(op Operator, list []Operator) bool {
+	for _, o := range list {
+		if op == o {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parse converts the raw query string value into the typed value for the field and operator.
+// The returned error message is meant to be recorded in the validator.
+func (f filterField) parse(op Operator, raw string) (interface{}, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, errors.New("must be provided")
+	}
+
+	switch f.kind {
+	case textArrayField:
+		values := strings.Split(raw, ",")
+		if len(values) > 100 {
+			return nil, errors.New("must not contain more than 100 values")
+		}
+
+		for i, value := range values {
+			values[i] = strings.TrimSpace(value)
+			if values[i] == "" {
+				return nil, errors.New("must be a comma separated list of non-empty values")
+			}
+		}
+		return values, nil
+
+	case intField:
+		if op == OpIn {
+			parts := strings.Split(raw, ",")
+			if len(parts) > 100 {
+				return nil, errors.New("must not contain more than 100 values")
+			}
+
+			values := make([]int64, len(parts))
+			for i, part := range parts {
+				n, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+				if err != nil {
+					return nil, errors.New("must be a comma separated list of integer values")
+				}
+				values[i] = n
+			}
+			return values, nil
+		}
+
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, errors.New("must be an integer value")
+		}
+		return n, nil
+
+	case timeField:
+		// Accept either a full RFC 3339 timestamp or a plain date.
+		for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+			t, err := time.Parse(layout, raw)
+			if err == nil {
+				return t, nil
+			}
+		}
+		return nil, errors.New("must be a RFC 3339 timestamp or a YYYY-MM-DD date")
+	}
+
+	return nil, errors.New("unsupported field")
+}
+
+// IsEmpty returns true if the expression has no condition.
+func (e FilterExpr) IsEmpty() bool {
+	return len(e.Conditions) == 0
+}
+
+// sql compiles the expression into a SQL boolean expression. The values are never interpolated,
+// each one is bound to a placeholder starting at $firstArg and returned in args.
+func (e FilterExpr) sql(firstArg int) (string, []interface{}) {
+	if e.IsEmpty() {
+		return "TRUE", nil
+	}
+
+	clauses := make([]string, len(e.Conditions))
+	args := make([]interface{}, len(e.Conditions))
+
+	for i, c := range e.Conditions {
+		placeholder := fmt.Sprintf("$%d", firstArg+i)
+
+		switch c.Operator {
+		case OpIn:
+			clauses[i] = fmt.Sprintf("%s = ANY(%s)", c.column, placeholder)
+			args[i] = pq.Array(c.Value)
+		case OpAny:
+			clauses[i] = fmt.Sprintf("%s && %s", c.column, placeholder)
+			args[i] = pq.Array(c.Value)
+		case OpAll:
+			clauses[i] = fmt.Sprintf("%s @> %s", c.column, placeholder)
+			args[i] = pq.Array(c.Value)
+		default:
+			clauses[i] = fmt.Sprintf("%s %s %s", c.column, sqlOperators[c.Operator], placeholder)
+			args[i] = c.Value
+		}
+	}
+
+	return strings.Join(clauses, " AND "), args
+}
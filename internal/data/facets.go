@@ -0,0 +1,122 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"github.com/luca0x333/go-greenlight/internal/validator"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FacetSafelist holds the facets which can be requested on the movies listing.
+var FacetSafelist = []string{"genres", "year", "decade"}
+
+// facetQueries maps every facet to the SELECT which aggregates it over the "filtered" CTE.
+// Each SELECT returns the facet name, the bucket value and the number of movies in the bucket.
+var facetQueries = map[string]string{
+	"genres": `SELECT 'genres', genre, count(*) FROM filtered, unnest(genres) AS genre GROUP BY genre`,
+	"year":   `SELECT 'year', year::text, count(*) FROM filtered GROUP BY year`,
+	"decade": `SELECT 'decade', ((year / 10) * 10)::text || 's', count(*) FROM filtered GROUP BY year / 10`,
+}
+
+// FacetCount struct holds a single bucket of a facet, e.g. "drama" with 42 movies.
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Facets type maps the facet name to its buckets.
+type Facets map[string][]FacetCount
+
+// GetFacets returns the aggregate counts for the requested facets over the movies matching the
+// same title, genres, search and filter expression as GetAll(). All the facets are computed in a
+// single query which scans the filtered movies only once.
+func (m MovieModel) GetFacets(ctx context.Context, title string, genres []string, search SearchQuery, expr FilterExpr, facets []string) (Facets, error) {
+	result := make(Facets, len(facets))
+
+	if len(facets) == 0 {
+		return result, nil
+	}
+
+	ctx, span := startSpan(ctx, "movies.get_facets")
+	defer span.End()
+
+	// The facet names have been checked against FacetSafelist by ValidateFacets(), but we only
+	// ever write the SQL from our own facetQueries map.
+	selects := make([]string, 0, len(facets))
+	for _, facet := range facets {
+		q, ok := facetQueries[facet]
+		if !ok {
+			panic("unsafe facet parameter: " + facet)
+		}
+
+		selects = append(selects, q)
+		result[facet] = []FacetCount{}
+	}
+
+	exprSQL, exprArgs := expr.sql(6)
+
+	query := fmt.Sprintf(`
+		WITH filtered AS (
+			SELECT genres, year FROM movies`+movieListWhere+`
+		)
+		%s`, exprSQL, strings.Join(selects, "\n\t\tUNION ALL\n\t\t"))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	args := append(movieListArgs(title, genres, search), exprArgs...)
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var facet string
+		var fc FacetCount
+
+		err := rows.Scan(&facet, &fc.Value, &fc.Count)
+		if err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+
+		result[facet] = append(result[facet], fc)
+	}
+
+	if err = rows.Err(); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	// Genres are ordered by popularity, years and decades chronologically.
+	for facet, counts := range result {
+		if facet == "genres" {
+			sort.Slice(counts, func(i, j int) bool {
+				if counts[i].Count != counts[j].Count {
+					return counts[i].Count > counts[j].Count
+				}
+				return counts[i].Value < counts[j].Value
+			})
+			continue
+		}
+
+		sort.Slice(counts, func(i, j int) bool {
+			return counts[i].Value < counts[j].Value
+		})
+	}
+
+	return result, nil
+}
+
+func ValidateFacets(v *validator.Validator, facets []string) {
+	for _, facet := range facets {
+		v.Check(validator.In(facet, FacetSafelist...), "facets", "invalid facet value")
+	}
+
+	v.Check(validator.Unique(facets), "facets", "must not contain duplicate values")
+}
@@ -0,0 +1,222 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"github.com/luca0x333/go-greenlight/internal/tracing"
+	"strings"
+	"time"
+)
+
+// Kinds of login attempts: the failures are counted per account, by email address whether it
+// is registered or not, and per client IP address.
+const (
+	LoginAttemptAccount = "account"
+	LoginAttemptIP      = "ip"
+)
+
+// LoginAttempt struct holds the consecutive failed logins of an account or an IP address.
+// LockedUntil is nil when the key isn't locked out.
+type LoginAttempt struct {
+	Kind          string     `json:"kind"`
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty"`
+}
+
+// LoginAttemptModel struct wraps the connection pool.
+type LoginAttemptModel struct {
+	DB *sql.DB
+}
+
+// loginAttemptKey function returns the key of an account or an IP address. The email addresses
+// are compared case insensitively, as in the users table.
+func loginAttemptKey(kind, key string) string {
+	if kind == LoginAttemptAccount {
+		return strings.ToLower(key)
+	}
+
+	return key
+}
+
+// Get method returns the failed logins of the account and of the IP address, if any, which
+// failed since the given time.
+func (m LoginAttemptModel) Get(ctx context.Context, email, ip string, since time.Time) ([]*LoginAttempt, error) {
+	ctx, span := startSpan(ctx, "login_attempts.get")
+	defer span.End()
+
+	query := `
+		SELECT kind, key, failures, last_failure_at, locked_until
+		FROM login_attempts
+		WHERE ((kind = $1 AND key = $2) OR (kind = $3 AND key = $4)) AND last_failure_at >= $5`
+
+	args := []interface{}{
+		LoginAttemptAccount, loginAttemptKey(LoginAttemptAccount, email),
+		LoginAttemptIP, ip,
+		since,
+	}
+
+	return m.query(ctx, span, query, args...)
+}
+
+// GetAll method returns the keys which failed since the given time, the most recent first, up
+// to 1000 of them.
+func (m LoginAttemptModel) GetAll(ctx context.Context, since time.Time) ([]*LoginAttempt, error) {
+	ctx, span := startSpan(ctx, "login_attempts.get_all")
+	defer span.End()
+
+	query := `
+		SELECT kind, key, failures, last_failure_at, locked_until
+		FROM login_attempts
+		WHERE last_failure_at >= $1
+		ORDER BY last_failure_at DESC
+		LIMIT 1000`
+
+	return m.query(ctx, span, query, since)
+}
+
+// query method runs a query returning login attempts.
+func (m LoginAttemptModel) query(ctx context.Context, span *tracing.Span, query string, args ...interface{}) ([]*LoginAttempt, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []*LoginAttempt{}
+
+	for rows.Next() {
+		var (
+			attempt     LoginAttempt
+			lockedUntil sql.NullTime
+		)
+
+		err := rows.Scan(&attempt.Kind, &attempt.Key, &attempt.Failures, &attempt.LastFailureAt, &lockedUntil)
+		if err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+
+		if lockedUntil.Valid {
+			attempt.LockedUntil = &lockedUntil.Time
+		}
+
+		attempts = append(attempts, &attempt)
+	}
+
+	if err = rows.Err(); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	return attempts, nil
+}
+
+// RecordFailure method counts a failed login of the account or the IP address at now. The
+// failures before since are forgotten and the count starts over. Once the count reaches
+// threshold, the key is locked out until lockedUntil: it returns true when this failure locked
+// the key, false if it didn't or if the key was already locked. The keys which have been
+// forgotten are deleted on the way.
+func (m LoginAttemptModel) RecordFailure(ctx context.Context, kind, key string, now, since time.Time, threshold int, lockedUntil time.Time) (bool, error) {
+	ctx, span := startSpan(ctx, "login_attempts.record_failure")
+	defer span.End()
+
+	key = loginAttemptKey(kind, key)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `
+		INSERT INTO login_attempts (kind, key, failures, last_failure_at)
+		VALUES ($1, $2, 1, $3)
+		ON CONFLICT (kind, key) DO UPDATE
+		SET failures = CASE
+				WHEN login_attempts.last_failure_at < $4 THEN 1
+				ELSE login_attempts.failures + 1
+			END,
+			last_failure_at = EXCLUDED.last_failure_at
+		RETURNING failures`
+
+	var failures int
+
+	err := m.DB.QueryRowContext(ctx, query, kind, key, now, since).Scan(&failures)
+	if err != nil {
+		span.RecordError(err)
+		return false, err
+	}
+
+	span.SetAttribute("login_attempts.failures", failures)
+
+	query = `
+		DELETE FROM login_attempts
+		WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < $2)`
+
+	_, err = m.DB.ExecContext(ctx, query, since, now)
+	if err != nil {
+		span.RecordError(err)
+		return false, err
+	}
+
+	if failures < threshold {
+		return false, nil
+	}
+
+	// The concurrent failures may all reach the threshold, only the one which finds the key
+	// unlocked locks it.
+	query = `
+		UPDATE login_attempts
+		SET locked_until = $3
+		WHERE kind = $1 AND key = $2 AND (locked_until IS NULL OR locked_until <= $4)`
+
+	result, err := m.DB.ExecContext(ctx, query, kind, key, lockedUntil, now)
+	if err != nil {
+		span.RecordError(err)
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		span.RecordError(err)
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// Delete method forgets the failed logins of the account or the IP address, which unlocks it.
+func (m LoginAttemptModel) Delete(ctx context.Context, kind, key string) error {
+	ctx, span := startSpan(ctx, "login_attempts.delete")
+	defer span.End()
+
+	query := `
+		DELETE FROM login_attempts
+		WHERE kind = $1 AND key = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, kind, loginAttemptKey(kind, key))
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	span.SetAttribute("db.rows_affected", rowsAffected)
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
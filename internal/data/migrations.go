@@ -0,0 +1,39 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// LatestMigrationVersion is the version of the last migration in the migrations directory, the
+// schema the models are written for. It must be bumped with every new migration.
+const LatestMigrationVersion = 14
+
+// MigrationVersion function returns the version of the last migration applied with the migrate
+// tool, and whether it failed half way (in which case the schema is "dirty").
+func MigrationVersion(ctx context.Context, db *sql.DB) (int64, bool, error) {
+	query := `
+		SELECT version, dirty
+		FROM schema_migrations
+		LIMIT 1`
+
+	ctx, span := startSpan(ctx, "schema_migrations.get")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var (
+		version int64
+		dirty   bool
+	)
+
+	err := db.QueryRowContext(ctx, query).Scan(&version, &dirty)
+	if err != nil {
+		span.RecordError(err)
+		return 0, false, err
+	}
+
+	return version, dirty, nil
+}
@@ -0,0 +1,45 @@
+package data
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestLatestMigrationVersion checks that LatestMigrationVersion was bumped with the last
+// migration added to the migrations directory.
+func TestLatestMigrationVersion(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("..", "..", "migrations", "*.up.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) == 0 {
+		t.Fatal("no migrations found")
+	}
+
+	latest := int64(0)
+
+	for _, file := range files {
+		name := filepath.Base(file)
+
+		i := strings.Index(name, "_")
+		if i < 0 {
+			t.Fatalf("%s: the name must be NNNNNN_title.up.sql", name)
+		}
+
+		version, err := strconv.ParseInt(name[:i], 10, 64)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if version > latest {
+			latest = version
+		}
+	}
+
+	if latest != LatestMigrationVersion {
+		t.Errorf("LatestMigrationVersion is %d, the last migration is %d", LatestMigrationVersion, latest)
+	}
+}
@@ -1,8 +1,12 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"github.com/luca0x333/go-greenlight/internal/cache"
+	"github.com/luca0x333/go-greenlight/internal/tracing"
+	"time"
 )
 
 var (
@@ -10,15 +14,117 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// DBTX interface is implemented by the connection pool and by a transaction, see
+// Models.Transaction().
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
 // Models struct wraps the MovieModel.
 type Models struct {
-	Movies MovieModel
-	Users  UserModel
+	Movies        MovieModel
+	Users         UserModel
+	Tokens        TokenModel
+	LoginAttempts LoginAttemptModel
+	TOTP          TOTPModel
+	Permissions   PermissionModel
+	APIKeys       APIKeyModel
+	OIDC          OIDCModel
+	EmailChanges  EmailChangeModel
+	AdminActions  AdminActionModel
+	db            *sql.DB
 }
 
 func NewModels(db *sql.DB) Models {
 	return Models{
-		Movies: MovieModel{DB: db},
-		Users:  UserModel{DB: db},
+		db:            db,
+		Movies:        MovieModel{DB: db},
+		Users:         UserModel{DB: db},
+		Tokens:        TokenModel{DB: db},
+		LoginAttempts: LoginAttemptModel{DB: db},
+		TOTP:          TOTPModel{DB: db},
+		Permissions:   PermissionModel{DB: db},
+		APIKeys:       APIKeyModel{DB: db},
+		OIDC:          OIDCModel{DB: db},
+		EmailChanges:  EmailChangeModel{DB: db},
+		AdminActions:  AdminActionModel{DB: db},
 	}
 }
+
+// Transaction method calls fn with a copy of the models whose Users, Tokens, TOTP, Permissions,
+// APIKeys, EmailChanges and AdminActions statements run in a transaction. The transaction is
+// committed if fn returns nil, and rolled back otherwise.
+func (m Models) Transaction(ctx context.Context, fn func(tx Models) error) error {
+	ctx, span := startSpan(ctx, "transaction")
+	defer span.End()
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	defer tx.Rollback()
+
+	txModels := m
+	txModels.Users.DB = tx
+	txModels.Tokens.DB = tx
+	txModels.TOTP.DB = tx
+	txModels.Permissions.DB = tx
+	txModels.APIKeys.DB = tx
+	txModels.EmailChanges.DB = tx
+	txModels.AdminActions.DB = tx
+
+	err = fn(txModels)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	return nil
+}
+
+// inTransaction function calls fn with a transaction of db, committed if fn returns nil, or with
+// db itself if it already is a transaction of Models.Transaction().
+func inTransaction(ctx context.Context, db DBTX, fn func(tx DBTX) error) error {
+	pool, ok := db.(*sql.DB)
+	if !ok {
+		return fn(db)
+	}
+
+	tx, err := pool.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// WithMovieCache returns a copy of the models where MovieModel.GetCached() and GetAllCached()
+// are served from store for the ttl duration. Hits, misses and shared loads are counted in stats.
+func (m Models) WithMovieCache(store cache.Cache, ttl time.Duration, stats *cache.Stats) Models {
+	m.Movies.cache = newReadCache(store, ttl, stats)
+	return m
+}
+
+// startSpan starts a client span for the named SQL statement (e.g. "movies.get"). The callers
+// record the number of rows and any error on the returned span before ending it.
+func startSpan(ctx context.Context, statement string) (context.Context, *tracing.Span) {
+	ctx, span := tracing.Start(ctx, "db "+statement, tracing.SpanKindClient)
+	span.SetAttribute("db.system", "postgresql")
+	span.SetAttribute("db.statement.name", statement)
+
+	return ctx, span
+}
@@ -2,30 +2,47 @@ package data
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/lib/pq"
 	"github.com/luca0x333/go-greenlight/internal/validator"
+	"html"
+	"sort"
+	"strings"
 	"time"
 )
 
+// Cache key prefixes. "movies:" must not be a prefix of "movie:" keys since all the listings
+// are invalidated at once with DeletePrefix().
+const (
+	movieCacheKeyPrefix     = "movie:"
+	movieListCacheKeyPrefix = "movies:"
+)
+
 type MovieModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	cache *readCache // nil when caching is disabled
 }
 
 type Movie struct {
-	ID        int64     `json:"id"`                // Unique integer ID for the movie
-	CreatedAt time.Time `json:"-"`                 // Timestamp for when the movie is added to our database
-	Title     string    `json:"title"`             // Movie title
-	Year      int32     `json:"year,omitempty"`    // Movie release year
-	Runtime   Runtime   `json:"runtime,omitempty"` // Movie runtime (in minutes)
-	Genres    []string  `json:"genres,omitempty"`  // Slice of genres for the movie (romance, comedy, etc.)
-	Version   int32     `json:"version"`           // The version number starts at 1 and will be incremented each
+	ID        int64     `json:"id"`                  // Unique integer ID for the movie
+	CreatedAt time.Time `json:"-"`                   // Timestamp for when the movie is added to our database
+	Title     string    `json:"title"`               // Movie title
+	Year      int32     `json:"year,omitempty"`      // Movie release year
+	Runtime   Runtime   `json:"runtime,omitempty"`   // Movie runtime (in minutes)
+	Genres    []string  `json:"genres,omitempty"`    // Slice of genres for the movie (romance, comedy, etc.)
+	Version   int32     `json:"version"`             // The version number starts at 1 and will be incremented each
+	Highlight string    `json:"highlight,omitempty"` // HTML escaped title with the search matches wrapped in <b></b> (search results only)
 }
 
 // Insert method accepts a pointer to a movie struct and insert a new record into the db.
-func (m MovieModel) Insert(movie *Movie) error {
+func (m MovieModel) Insert(ctx context.Context, movie *Movie) error {
+	ctx, span := startSpan(ctx, "movies.insert")
+	defer span.End()
+
 	query := `
 		INSERT INTO movies (title, year, runtime, genres) VALUES ($1, $2, $3, $4)
 		RETURNING id, created_at, version`
@@ -34,20 +51,34 @@ func (m MovieModel) Insert(movie *Movie) error {
 	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
 
 	// Create a context with a 3 seconds timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// Use QueryRow() method to execute the query on the connection pool,
 	// passing the args as variadic parameters and scanning the generated id, created_at and version
 	// values into the movie struct.
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	if err != nil {
+		span.RecordError(err)
+		return translateError(err)
+	}
+
+	span.SetAttribute("db.rows_affected", 1)
+
+	// A new movie can appear in any of the cached listings.
+	m.invalidate(0)
+
+	return nil
 }
 
-func (m MovieModel) Get(id int64) (*Movie, error) {
+func (m MovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
+	ctx, span := startSpan(ctx, "movies.get")
+	defer span.End()
+
 	query := `
 		SELECT id, created_at, title, year, runtime, genres, version FROM movies
 		WHERE id = $1`
@@ -57,7 +88,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 
 	// Use the context.WithTimeout() function to create a context.Context which carries
 	// a 3-second timeout deadline.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, id).Scan(
@@ -72,16 +103,23 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
+			span.SetAttribute("db.rows", 0)
 			return nil, ErrRecordNotFound
 		default:
+			span.RecordError(err)
 			return nil, err
 		}
 	}
 
+	span.SetAttribute("db.rows", 1)
+
 	return &movie, nil
 }
 
-func (m MovieModel) Update(movie *Movie) error {
+func (m MovieModel) Update(ctx context.Context, movie *Movie) error {
+	ctx, span := startSpan(ctx, "movies.update")
+	defer span.End()
+
 	query := `
 		UPDATE movies
 		SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1 WHERE id = $5 AND version = $6
@@ -98,74 +136,147 @@ func (m MovieModel) Update(movie *Movie) error {
 	}
 
 	// Create a context with a 3 seconds timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
+			span.SetAttribute("db.rows_affected", 0)
 			return ErrEditConflict
 		default:
-			return err
+			span.RecordError(err)
+			return translateError(err)
 		}
 	}
 
+	span.SetAttribute("db.rows_affected", 1)
+
+	m.invalidate(movie.ID)
+
 	return nil
 }
 
-func (m MovieModel) Delete(id int64) error {
+func (m MovieModel) Delete(ctx context.Context, id int64) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
+	ctx, span := startSpan(ctx, "movies.delete")
+	defer span.End()
+
 	query := `DELETE FROM movies WHERE id = $1`
 
 	// Create a context with a 3 seconds timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// ExecContext() method returns a sql.Result // object.
 	result, err := m.DB.ExecContext(ctx, query, id)
 	if err != nil {
-		return err
+		span.RecordError(err)
+		return translateError(err)
 	}
 
 	// RowsAffected() returns the number of affected row by the previous Exec() method.
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
+		span.RecordError(err)
 		return err
 	}
 
+	span.SetAttribute("db.rows_affected", rowsAffected)
+
 	// If rowsAffected is equal to 0 the movie tables did not containt that record.
 	if rowsAffected == 0 {
 		return ErrRecordNotFound
 	}
 
+	m.invalidate(id)
+
 	return nil
 }
 
+// movieListWhere is the WHERE clause shared by GetAll() and GetFacets(). It expects the arguments
+// returned by movieListArgs() to be bound to $1-$5 and the compiled filter expression to be
+// appended with a fmt verb.
+const movieListWhere = `
+		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') AND (genres @> $2 OR $2 = '{}')
+		AND ($3 = '' OR to_tsvector('simple', title) @@ to_tsquery('simple', $3) OR $5 <%% title)
+		AND ($4 = '' OR NOT to_tsvector('simple', title) @@ to_tsquery('simple', $4))
+		AND %s`
+
+// movieListArgs returns the placeholder values for $1-$5 in movieListWhere.
+func movieListArgs(title string, genres []string, search SearchQuery) []interface{} {
+	return []interface{}{
+		title,
+		pq.Array(genres),
+		search.tsquery(),
+		search.excludeTSQuery(),
+		search.fuzzyText(),
+	}
+}
+
+// The matches are delimited by control characters in the ts_headline() output, so that the title
+// can be HTML escaped before they are replaced by the <b></b> tags.
+const (
+	highlightStartSel = "\x01"
+	highlightStopSel  = "\x02"
+)
+
+// htmlHighlight function returns the HTML of a ts_headline() output, or an empty string if no
+// part of the title matched.
+func htmlHighlight(headline string) string {
+	if !strings.Contains(headline, highlightStartSel) {
+		return ""
+	}
+
+	replacer := strings.NewReplacer(highlightStartSel, "<b>", highlightStopSel, "</b>")
+
+	return replacer.Replace(html.EscapeString(headline))
+}
+
 // GetAll returns a slice of Movies.
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+// The search query is matched against the title using full text search, with a fallback to
+// trigram word similarity (pg_trgm) so that titles containing typos still match. Each movie is
+// given a relevance score, which can be used as sort column, and a highlighted title.
+// The conditions of the filter expression are compiled into placeholders following the fixed ones.
+func (m MovieModel) GetAll(ctx context.Context, title string, genres []string, search SearchQuery, expr FilterExpr, filters Filters) ([]*Movie, Metadata, error) {
+	ctx, span := startSpan(ctx, "movies.get_all")
+	defer span.End()
+
+	exprSQL, exprArgs := expr.sql(8)
+
 	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version FROM movies
-		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') AND (genres @> $2 OR $2 = '{}')
+		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version,
+			CASE WHEN $3 = '' THEN title
+				ELSE ts_headline('simple', title, to_tsquery('simple', $3),
+					'StartSel=' || chr(1) || ', StopSel=' || chr(2) || ', HighlightAll=true')
+			END,
+			CASE WHEN $3 = '' THEN 0
+				ELSE ts_rank(to_tsvector('simple', title), to_tsquery('simple', $3)) + word_similarity($5, title)
+			END AS relevance
+		FROM movies`+movieListWhere+`
 		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+		LIMIT $6 OFFSET $7`, exprSQL, filters.sortColumn(), filters.sortDirection())
 
 	// Create a context with a 3 seconds timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset()}
+	args := append(movieListArgs(title, genres, search), filters.limit(), filters.offset())
+	args = append(args, exprArgs...)
 
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
+		span.RecordError(err)
 		return nil, Metadata{}, err
 	}
 	defer rows.Close()
 
 	totalRecords := 0
+	relevance := 0.0
 
 	// Initialize a new empty slice to hold the data.
 	movies := []*Movie{}
@@ -183,25 +294,114 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
 			&movie.Version,
+			&movie.Highlight,
+			&relevance,
 		)
 		if err != nil {
+			span.RecordError(err)
 			return nil, Metadata{}, err
 		}
 
+		movie.Highlight = htmlHighlight(movie.Highlight)
+
 		movies = append(movies, &movie)
 	}
 
 	// Call rows.Err() to retrieve any error that was encountered during the iteration.
 	if err = rows.Err(); err != nil {
+		span.RecordError(err)
 		return nil, Metadata{}, err
 	}
 
+	span.SetAttribute("db.rows", len(movies))
+
 	// Generate a Metadata struct passing in the values from the client.
 	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
 
 	return movies, metadata, nil
 }
 
+// GetCached is the cached version of Get(). Movies which are not found are never cached.
+func (m MovieModel) GetCached(ctx context.Context, id int64) (*Movie, CacheInfo, error) {
+	if m.cache == nil {
+		movie, err := m.Get(ctx, id)
+		return movie, CacheInfo{}, err
+	}
+
+	var movie Movie
+
+	info, err := m.cache.load(ctx, fmt.Sprintf("%s%d", movieCacheKeyPrefix, id), &movie, func(ctx context.Context) (interface{}, error) {
+		return m.Get(ctx, id)
+	})
+	if err != nil {
+		return nil, CacheInfo{}, err
+	}
+
+	return &movie, info, nil
+}
+
+// movieList struct holds a cached GetAll() result.
+type movieList struct {
+	Movies   []*Movie
+	Metadata Metadata
+}
+
+// GetAllCached is the cached version of GetAll(). The cache key is built from the normalised
+// parameters, so that equivalent queries (e.g. the same genres in a different order) share an entry.
+func (m MovieModel) GetAllCached(ctx context.Context, title string, genres []string, search SearchQuery, expr FilterExpr, filters Filters) ([]*Movie, Metadata, CacheInfo, error) {
+	if m.cache == nil {
+		movies, metadata, err := m.GetAll(ctx, title, genres, search, expr, filters)
+		return movies, metadata, CacheInfo{}, err
+	}
+
+	sortedGenres := append([]string{}, genres...)
+	sort.Strings(sortedGenres)
+
+	key := fmt.Sprintf("%q|%q|%q|%q|%q|%v|%d|%d|%s",
+		strings.ToLower(strings.TrimSpace(title)),
+		sortedGenres,
+		search.tsquery(),
+		search.excludeTSQuery(),
+		search.fuzzyText(),
+		expr.Conditions,
+		filters.Page,
+		filters.PageSize,
+		filters.Sort,
+	)
+	sum := sha256.Sum256([]byte(key))
+
+	var list movieList
+
+	info, err := m.cache.load(ctx, movieListCacheKeyPrefix+hex.EncodeToString(sum[:]), &list, func(ctx context.Context) (interface{}, error) {
+		movies, metadata, err := m.GetAll(ctx, title, genres, search, expr, filters)
+		return movieList{Movies: movies, Metadata: metadata}, err
+	})
+	if err != nil {
+		return nil, Metadata{}, CacheInfo{}, err
+	}
+
+	// gob doesn't distinguish between a nil and an empty slice, but the API always returns an array.
+	if list.Movies == nil {
+		list.Movies = []*Movie{}
+	}
+
+	return list.Movies, list.Metadata, info, nil
+}
+
+// invalidate removes the cached movie with the given id (if id > 0) and all the cached listings.
+func (m MovieModel) invalidate(id int64) {
+	if m.cache == nil {
+		return
+	}
+
+	var keys []string
+	if id > 0 {
+		keys = append(keys, fmt.Sprintf("%s%d", movieCacheKeyPrefix, id))
+	}
+
+	m.cache.invalidate(keys, []string{movieListCacheKeyPrefix})
+}
+
 func ValidateMovie(v *validator.Validator, movie *Movie) {
 	// Use the Check() method to execute our validation checks.
 	// It will add the key and error message to the errors map if the checks are not true.
@@ -0,0 +1,167 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// OIDCLogin struct holds a pending OpenID Connect login, from the redirection to the provider
+// until the callback. Only the SHA-256 hash of the state is stored, as for the tokens.
+type OIDCLogin struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	Expiry       time.Time
+}
+
+// OIDCModel struct wraps the connection pool.
+type OIDCModel struct {
+	DB *sql.DB
+}
+
+// InsertLogin method stores a pending login. The expired logins, whose users never came back
+// from the provider, are deleted on the way.
+func (m OIDCModel) InsertLogin(ctx context.Context, login *OIDCLogin) error {
+	ctx, span := startSpan(ctx, "oidc_logins.insert")
+	defer span.End()
+
+	stateHash := sha256.Sum256([]byte(login.State))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `
+		DELETE FROM oidc_logins
+		WHERE expiry < $1`
+
+	_, err := m.DB.ExecContext(ctx, query, time.Now())
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	query = `
+		INSERT INTO oidc_logins (state_hash, nonce, code_verifier, expiry)
+		VALUES ($1, $2, $3, $4)`
+
+	_, err = m.DB.ExecContext(ctx, query, stateHash[:], login.Nonce, login.CodeVerifier, login.Expiry)
+	if err != nil {
+		span.RecordError(err)
+		return translateError(err)
+	}
+
+	span.SetAttribute("db.rows_affected", 1)
+
+	return nil
+}
+
+// ConsumeLogin method deletes and returns the pending login with the state, if it hasn't
+// expired, so that a callback can't be replayed. It returns ErrRecordNotFound otherwise.
+func (m OIDCModel) ConsumeLogin(ctx context.Context, state string) (*OIDCLogin, error) {
+	ctx, span := startSpan(ctx, "oidc_logins.consume")
+	defer span.End()
+
+	stateHash := sha256.Sum256([]byte(state))
+
+	query := `
+		DELETE FROM oidc_logins
+		WHERE state_hash = $1
+		RETURNING nonce, code_verifier, expiry`
+
+	login := OIDCLogin{State: state}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, stateHash[:]).Scan(&login.Nonce, &login.CodeVerifier, &login.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			span.SetAttribute("db.rows_affected", 0)
+			return nil, ErrRecordNotFound
+		default:
+			span.RecordError(err)
+			return nil, err
+		}
+	}
+
+	span.SetAttribute("db.rows_affected", 1)
+
+	if login.Expiry.Before(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	return &login, nil
+}
+
+// GetUserForIdentity method returns the user linked to the subject of the issuer.
+func (m OIDCModel) GetUserForIdentity(ctx context.Context, issuer, subject string) (*User, error) {
+	ctx, span := startSpan(ctx, "user_identities.get_user")
+	defer span.End()
+
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.email_verified, users.totp_enabled, users.version
+		FROM users
+		INNER JOIN user_identities
+		ON users.id = user_identities.user_id
+		WHERE user_identities.issuer = $1
+		AND user_identities.subject = $2`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, issuer, subject).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.EmailVerified,
+		&user.TOTPEnabled,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			span.SetAttribute("db.rows", 0)
+			return nil, ErrRecordNotFound
+		default:
+			span.RecordError(err)
+			return nil, err
+		}
+	}
+
+	span.SetAttribute("db.rows", 1)
+
+	return &user, nil
+}
+
+// LinkIdentity method links the subject of the issuer to the user, so that the next logins
+// find the user even if their email address changes at the provider.
+func (m OIDCModel) LinkIdentity(ctx context.Context, issuer, subject string, userID int64) error {
+	ctx, span := startSpan(ctx, "user_identities.insert")
+	defer span.End()
+
+	query := `
+		INSERT INTO user_identities (issuer, subject, user_id)
+		VALUES ($1, $2, $3)`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, issuer, subject, userID)
+	if err != nil {
+		span.RecordError(err)
+		return translateError(err)
+	}
+
+	span.SetAttribute("db.rows_affected", 1)
+
+	return nil
+}
@@ -0,0 +1,170 @@
+package data
+
+import (
+	"context"
+	"github.com/lib/pq"
+	"github.com/luca0x333/go-greenlight/internal/tracing"
+	"time"
+)
+
+// Permission codes, as stored in the permissions table.
+const (
+	PermissionMoviesRead  = "movies:read"
+	PermissionMoviesWrite = "movies:write"
+	PermissionUsersAdmin  = "users:admin"
+)
+
+// Permissions type holds the permission codes of a user or of an API key.
+type Permissions []string
+
+// Include method returns true if the permissions include the code.
+func (p Permissions) Include(code string) bool {
+	for _, permission := range p {
+		if permission == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Intersect method returns the permissions included in both p and other.
+func (p Permissions) Intersect(other Permissions) Permissions {
+	permissions := Permissions{}
+
+	for _, permission := range p {
+		if other.Include(permission) {
+			permissions = append(permissions, permission)
+		}
+	}
+
+	return permissions
+}
+
+// PermissionModel struct wraps the connection pool, or a transaction of Models.Transaction().
+type PermissionModel struct {
+	DB DBTX
+}
+
+// GetAll method returns all the permission codes.
+func (m PermissionModel) GetAll(ctx context.Context) (Permissions, error) {
+	ctx, span := startSpan(ctx, "permissions.get_all")
+	defer span.End()
+
+	query := `
+		SELECT code
+		FROM permissions
+		ORDER BY code`
+
+	return m.query(ctx, span, query)
+}
+
+// GetAllForUser method returns the permissions of the user.
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	ctx, span := startSpan(ctx, "permissions.get_all_for_user")
+	defer span.End()
+
+	query := `
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+		WHERE users_permissions.user_id = $1
+		ORDER BY permissions.code`
+
+	return m.query(ctx, span, query, userID)
+}
+
+// query method runs a query returning permission codes.
+func (m PermissionModel) query(ctx context.Context, span *tracing.Span, query string, args ...interface{}) (Permissions, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	span.SetAttribute("db.rows", len(permissions))
+
+	return permissions, nil
+}
+
+// AddForUser method grants the permissions to the user. The unknown codes are ignored.
+func (m PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	ctx, span := startSpan(ctx, "permissions.add_for_user")
+	defer span.End()
+
+	query := `
+		INSERT INTO users_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	if err != nil {
+		span.RecordError(err)
+		return translateError(err)
+	}
+
+	return nil
+}
+
+// RemoveForUser method revokes the permissions of the user. It returns ErrRecordNotFound if the
+// user had none of them.
+func (m PermissionModel) RemoveForUser(ctx context.Context, userID int64, codes ...string) error {
+	ctx, span := startSpan(ctx, "permissions.remove_for_user")
+	defer span.End()
+
+	query := `
+		DELETE FROM users_permissions
+		USING permissions
+		WHERE users_permissions.permission_id = permissions.id
+		AND users_permissions.user_id = $1
+		AND permissions.code = ANY($2)`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	span.SetAttribute("db.rows_affected", rowsAffected)
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package data
+
+import (
+	"github.com/luca0x333/go-greenlight/internal/validator"
+	"strings"
+	"unicode"
+)
+
+// searchTerm is a single element of a parsed search query. A term is either a single word or a
+// quoted phrase (several words which must appear next to each other), it can be a prefix match
+// (foo*) and it can be excluded from the results (-foo).
+type searchTerm struct {
+	words   []string
+	prefix  bool
+	exclude bool
+}
+
+// SearchQuery struct holds a parsed "q" query string parameter.
+// The raw value is only kept for validation, the SQL is built from the sanitized terms.
+type SearchQuery struct {
+	Raw   string
+	terms []searchTerm
+}
+
+// ParseSearchQuery function parses a free text search query which supports:
+//   - plain words:     matrix reloaded
+//   - quoted phrases:  "the matrix"
+//   - prefix matching: matr*
+//   - exclusion:       -reloaded, -"the matrix"
+//
+// Every word is lower-cased and stripped of anything which isn't a letter or a digit, so the
+// tsquery generated from it never contains any user supplied operator.
+func ParseSearchQuery(raw string) SearchQuery {
+	q := SearchQuery{Raw: raw}
+
+	runes := []rune(strings.TrimSpace(raw))
+
+	for i := 0; i < len(runes); {
+		// Skip the whitespaces between terms.
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		var term searchTerm
+
+		if runes[i] == '-' {
+			term.exclude = true
+			i++
+		}
+
+		// Read either a quoted phrase up to the closing quote (or the end of the query),
+		// or a single token up to the next whitespace.
+		var token string
+		if i < len(runes) && runes[i] == '"' {
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			token = string(runes[i+1 : end])
+			i = end + 1
+		} else {
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) {
+				end++
+			}
+			token = string(runes[i:end])
+			i = end
+		}
+
+		if strings.HasSuffix(token, "*") {
+			term.prefix = true
+		}
+
+		term.words = searchWords(token)
+		if len(term.words) > 0 {
+			q.terms = append(q.terms, term)
+		}
+	}
+
+	return q
+}
+
+// searchWords splits s into lower-cased words made only of letters and digits.
+func searchWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// IsEmpty returns true if the query contains no searchable term.
+func (q SearchQuery) IsEmpty() bool {
+	return len(q.terms) == 0
+}
+
+// tsquery returns a to_tsquery() compatible expression which ANDs the positive terms together.
+func (q SearchQuery) tsquery() string {
+	var parts []string
+
+	for _, term := range q.terms {
+		if !term.exclude {
+			parts = append(parts, term.tsquery())
+		}
+	}
+
+	return strings.Join(parts, " & ")
+}
+
+// excludeTSQuery returns a to_tsquery() compatible expression which ORs the excluded terms together.
+func (q SearchQuery) excludeTSQuery() string {
+	var parts []string
+
+	for _, term := range q.terms {
+		if term.exclude {
+			parts = append(parts, term.tsquery())
+		}
+	}
+
+	return strings.Join(parts, " | ")
+}
+
+// fuzzyText returns the positive words separated by spaces, used for the trigram similarity match.
+func (q SearchQuery) fuzzyText() string {
+	var words []string
+
+	for _, term := range q.terms {
+		if !term.exclude {
+			words = append(words, term.words...)
+		}
+	}
+
+	return strings.Join(words, " ")
+}
+
+// tsquery returns the expression for a single term. Words are quoted as lexemes, phrases use the
+// followed-by operator and the prefix flag applies to the last word.
+func (t searchTerm) tsquery() string {
+	lexemes := make([]string, len(t.words))
+
+	for i, word := range t.words {
+		lexemes[i] = "'" + word + "'"
+	}
+
+	if t.prefix {
+		lexemes[len(lexemes)-1] += ":*"
+	}
+
+	if len(lexemes) == 1 {
+		return lexemes[0]
+	}
+
+	return "(" + strings.Join(lexemes, " <-> ") + ")"
+}
+
+func ValidateSearchQuery(v *validator.Validator, q SearchQuery) {
+	v.Check(len(q.Raw) <= 500, "q", "must not be more than 500 bytes long")
+	v.Check(q.Raw == "" || !q.IsEmpty(), "q", "must contain at least one word")
+	v.Check(len(q.terms) <= 20, "q", "must not contain more than 20 terms")
+}
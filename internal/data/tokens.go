@@ -0,0 +1,156 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"github.com/luca0x333/go-greenlight/internal/validator"
+	"time"
+)
+
+// Token scopes.
+const (
+	ScopeAuthentication = "authentication"
+	// ScopeTwoFactor tokens are issued once the password of a user with TOTP enabled has been
+	// checked, and are exchanged with a TOTP or recovery code for an authentication token.
+	ScopeTwoFactor = "two-factor"
+	// ScopePasswordReset tokens are sent to the users whose password has been reset by an
+	// administrator, to choose a new one.
+	ScopePasswordReset = "password-reset"
+)
+
+// Token struct holds the data of a token. Only the SHA-256 hash of the token is stored in the
+// database, the plaintext is sent to the user once when the token is created.
+type Token struct {
+	Plaintext string    `json:"token"`
+	Hash      []byte    `json:"-"`
+	UserID    int64     `json:"-"`
+	Expiry    time.Time `json:"expiry"`
+	Scope     string    `json:"-"`
+}
+
+// generateToken function returns a new token for the user, valid for ttl. The plaintext is 16
+// random bytes encoded in base32, so it is 26 characters long.
+func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token := &Token{
+		UserID: userID,
+		Expiry: time.Now().Add(ttl),
+		Scope:  scope,
+	}
+
+	randomBytes := make([]byte, 16)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+
+	hash := sha256.Sum256([]byte(token.Plaintext))
+	token.Hash = hash[:]
+
+	return token, nil
+}
+
+func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
+	v.Check(tokenPlaintext != "", "token", "must be provided")
+	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
+}
+
+// TokenModel struct wraps the connection pool, or a transaction of Models.Transaction().
+type TokenModel struct {
+	DB DBTX
+}
+
+// New method generates a new token for the user and inserts it into the database.
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+// Insert method inserts the token into the database.
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
+	ctx, span := startSpan(ctx, "tokens.insert")
+	defer span.End()
+
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope)
+		VALUES ($1, $2, $3, $4)`
+
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		span.RecordError(err)
+		return translateError(err)
+	}
+
+	span.SetAttribute("db.rows_affected", 1)
+
+	return nil
+}
+
+// DeleteAllForUserExcept method deletes the tokens of the user with the given scope, except the
+// token with the given plaintext, e.g. the one of the current request.
+func (m TokenModel) DeleteAllForUserExcept(ctx context.Context, scope string, userID int64, tokenPlaintext string) error {
+	ctx, span := startSpan(ctx, "tokens.delete_all_for_user_except")
+	defer span.End()
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2 AND hash <> $3`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, scope, userID, tokenHash[:])
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err == nil {
+		span.SetAttribute("db.rows_affected", rowsAffected)
+	}
+
+	return nil
+}
+
+// DeleteAllForUser method deletes all the tokens of the user with the given scope.
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	ctx, span := startSpan(ctx, "tokens.delete_all_for_user")
+	defer span.End()
+
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, scope, userID)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err == nil {
+		span.SetAttribute("db.rows_affected", rowsAffected)
+	}
+
+	return nil
+}
@@ -0,0 +1,365 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"github.com/luca0x333/go-greenlight/internal/secretbox"
+	"github.com/luca0x333/go-greenlight/internal/validator"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTOTPEnabled     = errors.New("totp already enabled")
+	ErrTOTPUnavailable = errors.New("totp secrets encryption key not configured")
+)
+
+// recoveryCodeCost is the bcrypt cost of the recovery codes. They are random, unlike the
+// passwords, so a lower cost than Set() is enough and keeps checking the 10 codes of a user fast.
+const recoveryCodeCost = bcrypt.DefaultCost
+
+// RecoveryCodesCount is the number of recovery codes generated for a user.
+const RecoveryCodesCount = 10
+
+// TOTPModel struct wraps the connection pool and the box encrypting the TOTP secrets. The secret
+// of a user is stored in the users table as soon as the enrolment starts, but only used to log
+// in once confirmed with a first code (totp_enabled). The time step of the last accepted code is
+// stored too, so that a code can't be used twice. DB is the connection pool, or a transaction of
+// Models.Transaction().
+type TOTPModel struct {
+	DB  DBTX
+	box *secretbox.Box
+}
+
+// WithSecretBox returns a copy of the models where the TOTP secrets are encrypted with box.
+// Without it the TOTPModel methods reading or writing a secret fail with ErrTOTPUnavailable.
+func (m Models) WithSecretBox(box *secretbox.Box) Models {
+	m.TOTP.box = box
+	return m
+}
+
+// SetSecret method stores the secret of a pending enrolment, replacing any previous one. It fails
+// with ErrTOTPEnabled if the user has already enabled TOTP.
+func (m TOTPModel) SetSecret(ctx context.Context, userID int64, secret []byte) error {
+	if m.box == nil {
+		return ErrTOTPUnavailable
+	}
+
+	ctx, span := startSpan(ctx, "totp.set_secret")
+	defer span.End()
+
+	encrypted, err := m.box.Seal(secret)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE users
+		SET totp_secret = $2, totp_last_counter = 0
+		WHERE id = $1 AND NOT totp_enabled`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, encrypted)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrTOTPEnabled
+	}
+
+	return nil
+}
+
+// GetSecret method returns the secret of the user, enabled or pending, and the time step of the
+// last accepted code. It returns ErrRecordNotFound if the user has no secret.
+func (m TOTPModel) GetSecret(ctx context.Context, userID int64) ([]byte, int64, error) {
+	if m.box == nil {
+		return nil, 0, ErrTOTPUnavailable
+	}
+
+	ctx, span := startSpan(ctx, "totp.get_secret")
+	defer span.End()
+
+	query := `
+		SELECT totp_secret, totp_last_counter
+		FROM users
+		WHERE id = $1 AND totp_secret IS NOT NULL`
+
+	var (
+		encrypted   []byte
+		lastCounter int64
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&encrypted, &lastCounter)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, 0, ErrRecordNotFound
+		default:
+			span.RecordError(err)
+			return nil, 0, err
+		}
+	}
+
+	secret, err := m.box.Open(encrypted)
+	if err != nil {
+		span.RecordError(err)
+		return nil, 0, err
+	}
+
+	return secret, lastCounter, nil
+}
+
+// Enable method completes the enrolment of the user, whose first code had the given time step,
+// and stores the hashes of the recovery codes. It returns ErrEditConflict if the enrolment was
+// completed or cancelled in the meantime.
+func (m TOTPModel) Enable(ctx context.Context, userID int64, counter int64, recoveryCodeHashes [][]byte) error {
+	ctx, span := startSpan(ctx, "totp.enable")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := inTransaction(ctx, m.DB, func(tx DBTX) error {
+		query := `
+			UPDATE users
+			SET totp_enabled = true, totp_last_counter = $2
+			WHERE id = $1 AND totp_secret IS NOT NULL AND NOT totp_enabled`
+
+		result, err := tx.ExecContext(ctx, query, userID, counter)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrEditConflict
+		}
+
+		return replaceRecoveryCodes(ctx, tx, userID, recoveryCodeHashes)
+	})
+	if err != nil && !errors.Is(err, ErrEditConflict) {
+		span.RecordError(err)
+	}
+
+	return err
+}
+
+// UseCounter method records the time step of an accepted code. It returns false if a code of
+// the same or a later time step has already been used, i.e. the code is replayed.
+func (m TOTPModel) UseCounter(ctx context.Context, userID int64, counter int64) (bool, error) {
+	ctx, span := startSpan(ctx, "totp.use_counter")
+	defer span.End()
+
+	query := `
+		UPDATE users
+		SET totp_last_counter = $2
+		WHERE id = $1 AND totp_last_counter < $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, counter)
+	if err != nil {
+		span.RecordError(err)
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		span.RecordError(err)
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// Disable method removes the secret and the recovery codes of the user.
+func (m TOTPModel) Disable(ctx context.Context, userID int64) error {
+	ctx, span := startSpan(ctx, "totp.disable")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := inTransaction(ctx, m.DB, func(tx DBTX) error {
+		query := `
+			UPDATE users
+			SET totp_secret = NULL, totp_enabled = false, totp_last_counter = 0
+			WHERE id = $1`
+
+		_, err := tx.ExecContext(ctx, query, userID)
+		if err != nil {
+			return err
+		}
+
+		return replaceRecoveryCodes(ctx, tx, userID, nil)
+	})
+	if err != nil {
+		span.RecordError(err)
+	}
+
+	return err
+}
+
+// ReplaceRecoveryCodes method replaces the recovery codes of the user.
+func (m TOTPModel) ReplaceRecoveryCodes(ctx context.Context, userID int64, recoveryCodeHashes [][]byte) error {
+	ctx, span := startSpan(ctx, "totp.replace_recovery_codes")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := inTransaction(ctx, m.DB, func(tx DBTX) error {
+		return replaceRecoveryCodes(ctx, tx, userID, recoveryCodeHashes)
+	})
+	if err != nil {
+		span.RecordError(err)
+	}
+
+	return err
+}
+
+// replaceRecoveryCodes function deletes the recovery codes of the user and inserts the new ones
+// in the transaction.
+func replaceRecoveryCodes(ctx context.Context, tx DBTX, userID int64, recoveryCodeHashes [][]byte) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range recoveryCodeHashes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UseRecoveryCode method checks the code against the recovery codes of the user and, if one
+// matches, deletes it so that it can't be used again.
+func (m TOTPModel) UseRecoveryCode(ctx context.Context, userID int64, code string) (bool, error) {
+	ctx, span := startSpan(ctx, "totp.use_recovery_code")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT id, code_hash FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		span.RecordError(err)
+		return false, err
+	}
+	defer rows.Close()
+
+	code = normalizeRecoveryCode(code)
+	matchID := int64(0)
+
+	for rows.Next() {
+		var (
+			id   int64
+			hash []byte
+		)
+
+		err := rows.Scan(&id, &hash)
+		if err != nil {
+			span.RecordError(err)
+			return false, err
+		}
+
+		if bcrypt.CompareHashAndPassword(hash, []byte(code)) == nil {
+			matchID = id
+			break
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		span.RecordError(err)
+		return false, err
+	}
+
+	if matchID == 0 {
+		return false, nil
+	}
+
+	// The code may have been used concurrently.
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM recovery_codes WHERE id = $1`, matchID)
+	if err != nil {
+		span.RecordError(err)
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		span.RecordError(err)
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// GenerateRecoveryCodes function returns RecoveryCodesCount new recovery codes, to show to the
+// user once, and their bcrypt hashes to store. A code is 10 random base32 characters (50 bits),
+// in two groups of 5 for readability, e.g. "k3x9a-p2m7q".
+func GenerateRecoveryCodes() ([]string, [][]byte, error) {
+	codes := make([]string, RecoveryCodesCount)
+	hashes := make([][]byte, RecoveryCodesCount)
+
+	for i := range codes {
+		randomBytes := make([]byte, 7)
+
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(randomBytes))[:10]
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), recoveryCodeCost)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hash
+	}
+
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode function removes the separators and the case of a recovery code, as
+// typed by the user.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// ValidateTOTPCode function checks that the code has the format of a TOTP code (6 digits) or of
+// a recovery code.
+func ValidateTOTPCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) <= 20, "code", "must not be more than 20 bytes long")
+}
@@ -2,8 +2,12 @@ package data
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"github.com/luca0x333/go-greenlight/internal/validator"
 	"golang.org/x/crypto/bcrypt"
 	"time"
@@ -12,14 +16,19 @@ import (
 // User struct holds information about an user.
 // We using the json:"-" struct tag to prevent the Password and Version fields appearing in
 // any output when we encode it to JSON.
+// TOTPEnabled is true when the user logs in with a TOTP code after the password, see TOTPModel.
+// The users who aren't Activated, i.e. deactivated by an administrator, can't log in.
+// EmailVerified is true once the user has proven that they own the email address.
 type User struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	ID            int64     `json:"id"`
+	CreatedAt     time.Time `json:"created_at"`
+	Name          string    `json:"name"`
+	Email         string    `json:"email"`
+	Password      password  `json:"-"`
+	Activated     bool      `json:"activated"`
+	EmailVerified bool      `json:"email_verified"`
+	TOTPEnabled   bool      `json:"totp_enabled"`
+	Version       int       `json:"-"`
 }
 
 // plaintext is a pointer to a string so we are able to distinguish between a plaintext password not being present
@@ -33,9 +42,17 @@ var (
 	ErrDuplicateEmail = errors.New("duplicate email")
 )
 
-// UserModel struct wraps the connection pool.
+// AnonymousUser represents an unauthenticated request.
+var AnonymousUser = &User{}
+
+// IsAnonymous method returns true if the user is the AnonymousUser.
+func (u *User) IsAnonymous() bool {
+	return u == AnonymousUser
+}
+
+// UserModel struct wraps the connection pool, or a transaction of Models.Transaction().
 type UserModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
 // The Set method calculates the bcrypt hash of a plaintext password, and stores both
@@ -54,6 +71,19 @@ func (p *password) Set(plaintextPassword string) error {
 	return nil
 }
 
+// SetRandom method sets a random password that nobody knows, for the users who don't log in with
+// a password or who must choose a new one.
+func (p *password) SetRandom() error {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	return p.Set(base64.RawURLEncoding.EncodeToString(randomBytes))
+}
+
 // The Matches method checks whether the provided plaintext password matches the
 // hashed password stored in the struct, returning true if it matches and false otherwise.
 func (p *password) Matches(plaintextPassword string) (bool, error) {
@@ -70,40 +100,101 @@ func (p *password) Matches(plaintextPassword string) (bool, error) {
 	return true, nil
 }
 
+// dummyPasswordHash is the bcrypt hash, with the same cost as Set(), of a random password.
+var dummyPasswordHash = []byte("$2a$12$iIWklKoDUABAAI.zeBTScujnc7hOkwqtKnqbYucOe7iTW/NSfCxz.")
+
+// MatchDummyPassword function compares the plaintext password with a dummy hash, and never
+// matches. It is called when the user of a login doesn't exist, so that the response takes as
+// long as for an existing user and the timing doesn't tell whether an email address is registered.
+func MatchDummyPassword(plaintextPassword string) {
+	bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(plaintextPassword))
+}
+
 // Insert method insert a new record into the database for the user.
 // id, created_at and version are generated by the database, we return them to put the into the User struct.
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
+	ctx, span := startSpan(ctx, "users.insert")
+	defer span.End()
+
 	query := `
-		INSERT INTO users (name, email, password_hash, activated) VALUES ($1, $2, $3, $4)
+		INSERT INTO users (name, email, password_hash, activated, email_verified) VALUES ($1, $2, $3, $4, $5)
 		RETURNING id, created_at, version`
 
-	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
+	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated, user.EmailVerified}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
+	// A violation of the "users_email_key" constraint is translated into a
+	// *ConstraintError which also matches ErrDuplicateEmail.
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	if err != nil {
+		span.RecordError(err)
+		return translateError(err)
+	}
+
+	span.SetAttribute("db.rows_affected", 1)
+
+	return nil
+}
+
+// Get method retrieves the user with the ID.
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	ctx, span := startSpan(ctx, "users.get")
+	defer span.End()
+
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, email_verified, totp_enabled, version FROM users
+		WHERE id = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.EmailVerified,
+		&user.TOTPEnabled,
+		&user.Version,
+	)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
-			return ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			span.SetAttribute("db.rows", 0)
+			return nil, ErrRecordNotFound
 		default:
-			return err
+			span.RecordError(err)
+			return nil, err
 		}
 	}
 
-	return nil
+	span.SetAttribute("db.rows", 1)
+
+	return &user, nil
 }
 
 // GetByEmail method retrives the user details from the database based on the email.
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, span := startSpan(ctx, "users.get_by_email")
+	defer span.End()
+
 	query := `
-		SELECT id, created_at, name, email, password_hash, activated, version FROM users
+		SELECT id, created_at, name, email, password_hash, activated, email_verified, totp_enabled, version FROM users
 		WHERE email = $1`
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
@@ -113,26 +204,86 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.EmailVerified,
+		&user.TOTPEnabled,
 		&user.Version,
 	)
 
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
+			span.SetAttribute("db.rows", 0)
 			return nil, ErrRecordNotFound
 		default:
+			span.RecordError(err)
 			return nil, err
 		}
 	}
 
+	span.SetAttribute("db.rows", 1)
+
+	return &user, nil
+}
+
+// GetForToken method retrieves the user owning a token with the given scope which hasn't expired.
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	ctx, span := startSpan(ctx, "users.get_for_token")
+	defer span.End()
+
+	// Only the hash of the tokens is stored.
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.email_verified, users.totp_enabled, users.version
+		FROM users
+		INNER JOIN tokens
+		ON users.id = tokens.user_id
+		WHERE tokens.hash = $1
+		AND tokens.scope = $2
+		AND tokens.expiry > $3`
+
+	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.EmailVerified,
+		&user.TOTPEnabled,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			span.SetAttribute("db.rows", 0)
+			return nil, ErrRecordNotFound
+		default:
+			span.RecordError(err)
+			return nil, err
+		}
+	}
+
+	span.SetAttribute("db.rows", 1)
+
 	return &user, nil
 }
 
 // Update method updates the details for a specific user.
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
+	ctx, span := startSpan(ctx, "users.update")
+	defer span.End()
+
 	query := ` UPDATE users
-		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1 
-		WHERE id = $5 AND version = $6
+		SET name = $1, email = $2, password_hash = $3, activated = $4, email_verified = $5, version = version + 1 
+		WHERE id = $6 AND version = $7
 		RETURNING version`
 
 	args := []interface{}{
@@ -140,23 +291,128 @@ func (m UserModel) Update(user *User) error {
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.EmailVerified,
 		user.ID,
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
+	// No row is returned when the user has been updated or deleted since it was read.
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
-			return ErrDuplicateEmail
 		case errors.Is(err, sql.ErrNoRows):
-			return ErrRecordNotFound
+			span.SetAttribute("db.rows_affected", 0)
+			return ErrEditConflict
 		default:
-			return err
+			span.RecordError(err)
+			return translateError(err)
+		}
+	}
+
+	span.SetAttribute("db.rows_affected", 1)
+
+	return nil
+}
+
+// GetAll method returns a page of the users whose name or email address contains search (case
+// insensitively), optionally only the activated or deactivated ones, with the pagination metadata.
+func (m UserModel) GetAll(ctx context.Context, search string, activated *bool, filters Filters) ([]*User, Metadata, error) {
+	ctx, span := startSpan(ctx, "users.get_all")
+	defer span.End()
+
+	// strpos() rather than ILIKE so that % and _ in the search are matched literally.
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, name, email, password_hash, activated, email_verified, totp_enabled, version
+		FROM users
+		WHERE ($1 = '' OR strpos(lower(name), lower($1)) > 0 OR strpos(lower(email::text), lower($1)) > 0)
+		AND ($2::bool IS NULL OR activated = $2)
+		ORDER BY %s %s, id ASC
+		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, search, activated, filters.limit(), filters.offset())
+	if err != nil {
+		span.RecordError(err)
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.EmailVerified,
+			&user.TOTPEnabled,
+			&user.Version,
+		)
+		if err != nil {
+			span.RecordError(err)
+			return nil, Metadata{}, err
 		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		span.RecordError(err)
+		return nil, Metadata{}, err
+	}
+
+	span.SetAttribute("db.rows", len(users))
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
+}
+
+// Delete method deletes the user. Their tokens, API keys, permissions etc. are deleted with
+// them by the database.
+func (m UserModel) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, span := startSpan(ctx, "users.delete")
+	defer span.End()
+
+	query := `
+		DELETE FROM users
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	span.SetAttribute("db.rows_affected", rowsAffected)
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
 	}
 
 	return nil
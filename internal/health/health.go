@@ -0,0 +1,173 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Status of a check or of a whole report.
+const (
+	StatusPass = "pass"
+	StatusFail = "fail"
+)
+
+// ErrShuttingDown is the error reported once the application has started its graceful shutdown.
+var ErrShuttingDown = errors.New("the server is shutting down")
+
+// CheckFunc is the function checking a dependency. It must return when ctx is done.
+type CheckFunc func(ctx context.Context) error
+
+type check struct {
+	name     string
+	critical bool
+	fn       CheckFunc
+}
+
+// Result struct holds the outcome of a single check.
+type Result struct {
+	Status   string
+	Critical bool
+	Latency  time.Duration
+	Error    string
+}
+
+// Report struct holds the outcome of all the checks. Healthy is false as soon as one of the
+// critical checks fails, the failure of a non critical check only makes the report Degraded.
+type Report struct {
+	Healthy   bool
+	Degraded  bool
+	CheckedAt time.Time
+	Results   map[string]Result
+}
+
+// Registry struct holds the registered checks and the last report, which is reused for cacheTTL
+// so that frequent probes don't hammer the dependencies.
+type Registry struct {
+	timeout      time.Duration
+	cacheTTL     time.Duration
+	checks       []check
+	shuttingDown int32
+
+	mu   sync.Mutex
+	last *Report
+}
+
+// New function returns an empty Registry. Each check is given timeout to complete and the
+// reports are cached for cacheTTL.
+func New(timeout, cacheTTL time.Duration) *Registry {
+	return &Registry{
+		timeout:  timeout,
+		cacheTTL: cacheTTL,
+	}
+}
+
+// Register adds a check. A failing critical check makes the whole report unhealthy.
+// Register must not be called once the checks have started to run.
+func (r *Registry) Register(name string, critical bool, fn CheckFunc) {
+	r.checks = append(r.checks, check{name: name, critical: critical, fn: fn})
+}
+
+// SetShuttingDown makes every following report unhealthy, without running the checks.
+func (r *Registry) SetShuttingDown() {
+	atomic.StoreInt32(&r.shuttingDown, 1)
+}
+
+// Check runs all the checks concurrently and returns the report, or returns the cached report if
+// it is recent enough. Concurrent callers wait for the same run. The checks don't use the context
+// of the caller, so that a cancelled probe doesn't leave a failing report in the cache.
+func (r *Registry) Check() Report {
+	if atomic.LoadInt32(&r.shuttingDown) == 1 {
+		return Report{
+			CheckedAt: time.Now(),
+			Results: map[string]Result{
+				"shutdown": {Status: StatusFail, Critical: true, Error: ErrShuttingDown.Error()},
+			},
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.last != nil && time.Since(r.last.CheckedAt) < r.cacheTTL {
+		return *r.last
+	}
+
+	report := r.run(context.Background())
+	r.last = &report
+
+	return report
+}
+
+func (r *Registry) run(ctx context.Context) Report {
+	results := make([]Result, len(r.checks))
+
+	var wg sync.WaitGroup
+
+	for i, c := range r.checks {
+		wg.Add(1)
+		go func(i int, c check) {
+			defer wg.Done()
+			results[i] = r.runOne(ctx, c)
+		}(i, c)
+	}
+
+	wg.Wait()
+
+	report := Report{
+		Healthy:   true,
+		CheckedAt: time.Now(),
+		Results:   make(map[string]Result, len(r.checks)),
+	}
+
+	for i, c := range r.checks {
+		if results[i].Status == StatusFail {
+			if c.critical {
+				report.Healthy = false
+			} else {
+				report.Degraded = true
+			}
+		}
+
+		report.Results[c.name] = results[i]
+	}
+
+	return report
+}
+
+// runOne runs a single check with the timeout. The check runs in its own goroutine so that one
+// ignoring ctx can't block the report, its result is then discarded.
+func (r *Registry) runOne(ctx context.Context, c check) Result {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	start := time.Now()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.fn(ctx)
+	}()
+
+	var err error
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := Result{
+		Status:   StatusPass,
+		Critical: c.critical,
+		Latency:  time.Since(start),
+	}
+
+	if err != nil {
+		result.Status = StatusFail
+		result.Error = err.Error()
+	}
+
+	return result
+}
@@ -1,11 +1,15 @@
 package jsonlog
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,56 +17,189 @@ import (
 type Level int8
 
 const (
-	LevelInfo  Level = iota // Has the value 0
-	LevelError              // Has the value 1
-	LevelFatal              // Has the value 2
-	LevelOff                // Has the value 3
+	LevelDebug Level = iota // Has the value 0
+	LevelInfo               // Has the value 1
+	LevelWarn               // Has the value 2
+	LevelError              // Has the value 3
+	LevelFatal              // Has the value 4
+	LevelOff                // Has the value 5
 )
 
 // String returns a human friendly string for the severity level.
 func (l Level) String() string {
 	switch l {
+	case LevelDebug:
+		return "DEBUG"
 	case LevelInfo:
 		return "INFO"
+	case LevelWarn:
+		return "WARN"
 	case LevelError:
 		return "ERROR"
 	case LevelFatal:
 		return "FATAL"
+	case LevelOff:
+		return "OFF"
 	default:
 		return ""
 	}
 }
 
-// Logger struct holds the output destination that the log entries will be written to,
-// the minimum log severity level that log entries will be written for and
+// ParseLevel returns the level matching s, case insensitively (e.g. "debug" or "WARN").
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToUpper(strings.TrimSpace(s)) {
+	case "DEBUG":
+		return LevelDebug, nil
+	case "INFO":
+		return LevelInfo, nil
+	case "WARN", "WARNING":
+		return LevelWarn, nil
+	case "ERROR":
+		return LevelError, nil
+	case "FATAL":
+		return LevelFatal, nil
+	case "OFF":
+		return LevelOff, nil
+	default:
+		return LevelOff, fmt.Errorf("invalid log level %q", s)
+	}
+}
+
+// Sink struct is an output destination for the log entries. Only the entries at or above
+// MinLevel (and at or above the level of the Logger) are written to Out.
+type Sink struct {
+	Out      io.Writer
+	MinLevel Level
+}
+
+// core struct holds the state shared by a Logger and all its child loggers: the sinks,
+// the minimum level and the stack trace level, which can be changed at runtime, and
 // a mutex for coordinating writes.
+type core struct {
+	sinks           []Sink
+	minLevel        int32
+	stackTraceLevel int32
+	mu              sync.Mutex
+}
+
+// Logger struct holds the shared core and the fields added to every entry it writes.
 type Logger struct {
-	out      io.Writer
-	minLevel Level
-	mu       sync.Mutex
+	core   *core
+	fields map[string]interface{}
 }
 
-// New function return a new Logger instance.
+// New function return a new Logger instance writing the entries at or above minLevel to out.
 func New(out io.Writer, minLevel Level) *Logger {
+	return NewWithSinks(minLevel, Sink{Out: out, MinLevel: LevelDebug})
+}
+
+// NewWithSinks function returns a new Logger instance writing the entries at or above minLevel
+// to each sink whose own MinLevel is also met. A stack trace is captured for the entries at the
+// ERROR and FATAL levels, see SetStackTraceLevel().
+func NewWithSinks(minLevel Level, sinks ...Sink) *Logger {
 	return &Logger{
-		out:      out,
-		minLevel: minLevel,
+		core: &core{
+			sinks:           sinks,
+			minLevel:        int32(minLevel),
+			stackTraceLevel: int32(LevelError),
+		},
+	}
+}
+
+// Level returns the current minimum level of the logger.
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(&l.core.minLevel))
+}
+
+// SetLevel changes the minimum level of the logger, and of all its child loggers, at runtime.
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.core.minLevel, int32(level))
+}
+
+// SetStackTraceLevel changes the level from which a stack trace is captured and included in the
+// entries. Use LevelOff to never capture stack traces.
+func (l *Logger) SetStackTraceLevel(level Level) {
+	atomic.StoreInt32(&l.core.stackTraceLevel, int32(level))
+}
+
+// With returns a child logger which adds fields to the properties of every entry it writes.
+// The properties passed to the Print methods take precedence over the fields.
+func (l *Logger) With(fields map[string]interface{}) *Logger {
+	return &Logger{
+		core:   l.core,
+		fields: mergeFields(l.fields, fields),
+	}
+}
+
+// fieldsContextKey is the context key of the fields stored with ContextWithFields().
+type fieldsContextKey struct{}
+
+// ContextWithFields returns a copy of ctx holding fields, on top of the fields already in ctx.
+// They are added to the entries written with the Ctx variants of the Print methods, e.g. to
+// include the request ID in every entry logged while serving a request.
+func ContextWithFields(ctx context.Context, fields map[string]interface{}) context.Context {
+	return context.WithValue(ctx, fieldsContextKey{}, mergeFields(FieldsFromContext(ctx), fields))
+}
+
+// FieldsFromContext returns the fields stored in ctx with ContextWithFields().
+func FieldsFromContext(ctx context.Context) map[string]interface{} {
+	fields, _ := ctx.Value(fieldsContextKey{}).(map[string]interface{})
+	return fields
+}
+
+// mergeFields returns a new map holding the fields of base overridden by the fields of extra.
+func mergeFields(base, extra map[string]interface{}) map[string]interface{} {
+	if len(base) == 0 && len(extra) == 0 {
+		return nil
+	}
+
+	merged := make(map[string]interface{}, len(base)+len(extra))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range extra {
+		merged[k] = v
+	}
+
+	return merged
+}
+
+// normalizeValue converts the property values which don't have a useful JSON representation:
+// durations are written in their human friendly format ("1.5s") instead of nanoseconds and
+// errors as their message. Any other value is marshaled as is, including nested maps and structs.
+func normalizeValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case time.Time:
+		return value
+	case time.Duration:
+		return value.String()
+	case error:
+		return value.Error()
+	case fmt.Stringer:
+		return value.String()
+	default:
+		return v
 	}
 }
 
 // Print is an internal method for writing the log entry.
-func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
-	if level < l.minLevel {
+func (l *Logger) print(level Level, message string, properties map[string]interface{}) (int, error) {
+	if level < l.Level() {
 		return 0, nil
 	}
 
+	properties = mergeFields(l.fields, properties)
+	for k, v := range properties {
+		properties[k] = normalizeValue(v)
+	}
+
 	// Declare an anonymous struct holding the data for the log entry.
 	aux := struct {
-		Level      string            `json:"level"`
-		Time       string            `json:"time"`
-		Message    string            `json:"message"`
-		Properties map[string]string `json:"properties,omitempty"`
-		Trace      string            `json:"trace,omitempty"`
+		Level      string                 `json:"level"`
+		Time       string                 `json:"time"`
+		Message    string                 `json:"message"`
+		Properties map[string]interface{} `json:"properties,omitempty"`
+		Trace      string                 `json:"trace,omitempty"`
 	}{
 		Level:      level.String(),
 		Time:       time.Now().UTC().Format(time.RFC3339),
@@ -70,43 +207,88 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 		Properties: properties,
 	}
 
-	// Include a stack trace for entries at ERROR and FATAL levels.
-	if level >= LevelError {
+	// Include a stack trace for entries at or above the stack trace level (ERROR by default).
+	if level >= Level(atomic.LoadInt32(&l.core.stackTraceLevel)) {
 		aux.Trace = string(debug.Stack())
 	}
 
 	// Marshal the anonymous struct to JSON and store it in the line variable.
 	// If there is any error set the contents of the log entry as plain-text error message.
-	var line []byte
-	line, err := json.Marshal(aux)
-	if err != nil {
-		line = []byte(LevelError.String() + ": unable to marshal log message:" + err.Error())
+	line, merr := json.Marshal(aux)
+	if merr != nil {
+		line = []byte(LevelError.String() + ": unable to marshal log message:" + merr.Error())
 	}
+	line = append(line, '\n')
 
 	// Lock the mutex so that no two writes ad the destination can happen concurrently.
 	// Without this mutex lock, it’s possible that the content of multiple log entries
 	// would be written at exactly the same time and be mixed up in the output,
 	// rather than each entry being written in full on its own line.
-	l.mu.Lock()
-	defer l.mu.Unlock()
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
 
-	// Write the log entry followed by a new line.
-	return l.out.Write(append(line, '\n'))
+	// Write the log entry followed by a new line to every sink accepting its level.
+	// We keep the result of the first failing sink but still write to the others.
+	var (
+		n   int
+		err error
+	)
+
+	for _, sink := range l.core.sinks {
+		if level < sink.MinLevel {
+			continue
+		}
+
+		written, werr := sink.Out.Write(line)
+		if err == nil {
+			n, err = written, werr
+		}
+	}
+
+	return n, err
+}
+
+func (l *Logger) PrintDebug(message string, properties map[string]interface{}) {
+	l.print(LevelDebug, message, properties)
 }
 
-func (l *Logger) PrintInfo(message string, properties map[string]string) {
+func (l *Logger) PrintInfo(message string, properties map[string]interface{}) {
 	l.print(LevelInfo, message, properties)
 }
 
-func (l *Logger) PrintError(err error, properties map[string]string) {
+func (l *Logger) PrintWarn(message string, properties map[string]interface{}) {
+	l.print(LevelWarn, message, properties)
+}
+
+func (l *Logger) PrintError(err error, properties map[string]interface{}) {
 	l.print(LevelError, err.Error(), properties)
 }
 
-func (l *Logger) PrintFatal(err error, properties map[string]string) {
+func (l *Logger) PrintFatal(err error, properties map[string]interface{}) {
 	l.print(LevelFatal, err.Error(), properties)
 	os.Exit(1)
 }
 
+// PrintDebugCtx is the same as PrintDebug, with the fields stored in ctx added to the properties.
+func (l *Logger) PrintDebugCtx(ctx context.Context, message string, properties map[string]interface{}) {
+	l.print(LevelDebug, message, mergeFields(FieldsFromContext(ctx), properties))
+}
+
+// PrintInfoCtx is the same as PrintInfo, with the fields stored in ctx added to the properties.
+func (l *Logger) PrintInfoCtx(ctx context.Context, message string, properties map[string]interface{}) {
+	l.print(LevelInfo, message, mergeFields(FieldsFromContext(ctx), properties))
+}
+
+// PrintWarnCtx is the same as PrintWarn, with the fields stored in ctx added to the properties.
+func (l *Logger) PrintWarnCtx(ctx context.Context, message string, properties map[string]interface{}) {
+	l.print(LevelWarn, message, mergeFields(FieldsFromContext(ctx), properties))
+}
+
+// PrintErrorCtx is the same as PrintError, with the fields stored in ctx added to the properties.
+func (l *Logger) PrintErrorCtx(ctx context.Context, err error, properties map[string]interface{}) {
+	l.print(LevelError, err.Error(), mergeFields(FieldsFromContext(ctx), properties))
+}
+
 // We also implement a Write() method on our Logger type so that it satisfies the io.Writer interface
 // This writes a log entry at the ERROR level with no additional properties.
 func (l *Logger) Write(message []byte) (n int, err error) {
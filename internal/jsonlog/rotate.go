@@ -0,0 +1,222 @@
+package jsonlog
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the timestamp appended to the name of the rotated files.
+const backupTimeFormat = "20060102T150405.000"
+
+// rotateRetryDelay is how long the writes carry on in the current file after a failed rotation
+// before it is retried.
+const rotateRetryDelay = time.Minute
+
+// RotateOptions struct holds the rotation settings of a RotatingFile.
+// A zero MaxSize or Interval disables the corresponding rotation trigger and a zero
+// MaxBackups keeps all the rotated files. OnError is called from its own goroutine, so that it
+// can log through a logger writing to the file.
+type RotateOptions struct {
+	MaxSize    int64         // Rotate when the file would grow over MaxSize bytes
+	Interval   time.Duration // Rotate when the file has been open for Interval
+	MaxBackups int           // Number of rotated files to keep
+	Compress   bool          // Gzip the rotated files
+	OnError    func(error)   // Called when a rotation triggered by a write fails
+}
+
+// RotatingFile struct is an io.WriteCloser appending to a file which is rotated when it grows
+// too big or gets too old. The rotated files are renamed <path>.<timestamp> and optionally
+// gzipped in the background.
+type RotatingFile struct {
+	path     string
+	opts     RotateOptions
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	retryAt  time.Time
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+}
+
+// OpenRotatingFile function opens (or creates) the file at path for appending.
+func OpenRotatingFile(path string, opts RotateOptions) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path: path,
+		opts: opts,
+	}
+
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = time.Now()
+
+	return nil
+}
+
+// Write appends p to the file, rotating it first if needed. A single write is never split
+// across two files. If the rotation fails, p is still written to the current file, the error is
+// reported to OnError and the rotation is retried after rotateRetryDelay.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tooBig := f.opts.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.opts.MaxSize
+	tooOld := f.opts.Interval > 0 && time.Since(f.openedAt) >= f.opts.Interval
+
+	if (tooBig || tooOld) && !time.Now().Before(f.retryAt) {
+		err := f.rotate()
+		if err != nil {
+			f.retryAt = time.Now().Add(rotateRetryDelay)
+			f.reportError(err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// Rotate forces the rotation of the file.
+func (f *RotatingFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.rotate()
+}
+
+// rotate must be called with the mutex held. The file is renamed before it is closed, so that
+// on failure the current file is kept open and the writes carry on in it.
+func (f *RotatingFile) rotate() error {
+	old := f.file
+	backup := f.path + "." + time.Now().Format(backupTimeFormat)
+
+	err := os.Rename(f.path, backup)
+	if err != nil {
+		return err
+	}
+
+	err = f.open()
+	if err != nil {
+		// Move the file back to its path, where the writes are expected.
+		os.Rename(backup, f.path)
+		return err
+	}
+
+	// The new file is in use, the rotation has succeeded even if the old one fails to close.
+	err = old.Close()
+	if err != nil {
+		f.reportError(err)
+	}
+
+	// Compress and prune in the background so that the writes don't wait on it.
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+
+		if f.opts.Compress {
+			compressFile(backup)
+		}
+
+		f.prune()
+	}()
+
+	return nil
+}
+
+// reportError passes the error to OnError, if any, without blocking the writes.
+func (f *RotatingFile) reportError(err error) {
+	if f.opts.OnError != nil {
+		go f.opts.OnError(err)
+	}
+}
+
+// compressFile gzips path into path.gz and removes path. On failure the uncompressed
+// file is kept.
+func compressFile(path string) {
+	src, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+
+	gz := gzip.NewWriter(dst)
+
+	_, err = io.Copy(gz, src)
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(path + ".gz")
+		return
+	}
+
+	os.Remove(path)
+}
+
+// prune removes the oldest rotated files so that at most MaxBackups are kept.
+func (f *RotatingFile) prune() {
+	if f.opts.MaxBackups <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+
+	// The timestamp format sorts lexically, ignoring the .gz suffix.
+	sort.Slice(matches, func(i, j int) bool {
+		return strings.TrimSuffix(matches[i], ".gz") > strings.TrimSuffix(matches[j], ".gz")
+	})
+
+	for i, match := range matches {
+		if i >= f.opts.MaxBackups {
+			os.Remove(match)
+		}
+	}
+}
+
+// Close waits for the background compressions and closes the file.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.wg.Wait()
+
+	return f.file.Close()
+}
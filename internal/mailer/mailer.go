@@ -2,8 +2,11 @@ package mailer
 
 import (
 	"bytes"
+	"context"
 	"embed"
 	"github.com/go-mail/mail/v2"
+	"github.com/luca0x333/go-greenlight/internal/tracing"
+	"sync/atomic"
 	"text/template"
 	"time"
 )
@@ -17,26 +20,68 @@ import (
 //go:embed "templates"
 var templateFS embed.FS
 
-// Mailer struct holds mail.Dialer used to connect to the SMTP server and the sender information.
+// Mailer struct holds the SMTP server settings and the send counters. Both are pointers so that
+// they are shared by all the copies of the Mailer, including a Reconfigure() of the server.
 type Mailer struct {
+	server *atomic.Value
+	stats  *Stats
+}
+
+// server struct holds mail.Dialer used to connect to the SMTP server and the sender information.
+type server struct {
 	dialer *mail.Dialer
 	sender string
 }
 
+// Stats struct holds the number of emails successfully sent and the number of emails which
+// couldn't be sent after all the retries. The fields are updated atomically.
+type Stats struct {
+	Sent   int64
+	Failed int64
+}
+
 func New(host string, port int, username, password, sender string) Mailer {
+	m := Mailer{
+		server: &atomic.Value{},
+		stats:  &Stats{},
+	}
+
+	m.Reconfigure(host, port, username, password, sender)
+
+	return m
+}
+
+// Reconfigure method replaces the SMTP server settings and credentials. The emails being sent
+// complete with the previous settings.
+func (m Mailer) Reconfigure(host string, port int, username, password, sender string) {
 	dialer := mail.NewDialer(host, port, username, password)
 	dialer.Timeout = 5 * time.Second
 
-	return Mailer{
-		dialer: dialer,
-		sender: sender,
+	m.server.Store(server{dialer: dialer, sender: sender})
+}
+
+// Stats returns a copy of the send counters.
+func (m Mailer) Stats() Stats {
+	return Stats{
+		Sent:   atomic.LoadInt64(&m.stats.Sent),
+		Failed: atomic.LoadInt64(&m.stats.Failed),
 	}
 }
 
-func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
+// Send method renders the template and sends the email, retrying once on failure.
+// The span of the send is a child of the span in ctx, if any.
+func (m Mailer) Send(ctx context.Context, recipient, templateFile string, data interface{}) error {
+	_, span := tracing.Start(ctx, "mailer.send", tracing.SpanKindClient)
+	defer span.End()
+
+	span.SetAttribute("mailer.template", templateFile)
+
+	srv := m.server.Load().(server)
+
 	// Use the ParseFS() method to parse the required template file from the embedded file system.
 	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
 	if err != nil {
+		span.RecordError(err)
 		return err
 	}
 
@@ -65,7 +110,7 @@ func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
 
 	// Use the SetHeader() method to set the email recipient, sender and subject headers.
 	msg.SetHeader("To", recipient)
-	msg.SetHeader("From", m.sender)
+	msg.SetHeader("From", srv.sender)
 	msg.SetHeader("Subject", subject.String())
 
 	// Use SetBody() method to set the plain-text body, and the AddAlternative() method to set the HTML body.
@@ -75,13 +120,30 @@ func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
 
 	// DialAndSend() opens a connection to the SMTP server, sends the message, then closes the connection.
 	for i := 1; i < 3; i++ {
-		err = m.dialer.DialAndSend(msg)
+		span.SetAttribute("mailer.attempts", i)
+
+		err = srv.dialer.DialAndSend(msg)
 		if nil == err {
+			atomic.AddInt64(&m.stats.Sent, 1)
 			return nil
 		}
 
 		time.Sleep(500 * time.Millisecond)
 	}
 
-	return nil
+	// Return the error of the last attempt so that the caller can log it.
+	atomic.AddInt64(&m.stats.Failed, 1)
+	span.RecordError(err)
+	return err
+}
+
+// Ping method opens (and authenticates) a connection to the SMTP server and closes it,
+// to check that emails can be sent.
+func (m Mailer) Ping() error {
+	conn, err := m.server.Load().(server).dialer.Dial()
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
 }
@@ -0,0 +1,411 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID     = "greenlight"
+	testClientSecret = "s3cret"
+	testRedirectURL  = "https://api.example.com/v1/oidc/callback"
+)
+
+// testIdP struct is an OpenID provider serving the discovery document, the JWKS and the token
+// endpoint. The token endpoint exchanges the codes issued by authorize() for their ID token,
+// after checking the client credentials and the PKCE code verifier.
+type testIdP struct {
+	server *httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]testCode
+}
+
+type testCode struct {
+	challenge string
+	idToken   string
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &testIdP{rsaKey: rsaKey, ecKey: ecKey, codes: make(map[string]testCode)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/token", idp.token)
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+func (idp *testIdP) issuer() string {
+	return idp.server.URL
+}
+
+func (idp *testIdP) provider() *Provider {
+	return NewProvider(Config{
+		Issuer:       idp.issuer(),
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  testRedirectURL,
+		Scopes:       []string{"openid", "email"},
+	}, idp.server.Client())
+}
+
+func (idp *testIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(Metadata{
+		Issuer:                idp.issuer(),
+		AuthorizationEndpoint: idp.issuer() + "/authorize",
+		TokenEndpoint:         idp.issuer() + "/token",
+		JWKSURI:               idp.issuer() + "/jwks",
+	})
+}
+
+func (idp *testIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "rsa",
+				"use": "sig",
+				"n":   b64(idp.rsaKey.N.Bytes()),
+				"e":   b64(big.NewInt(int64(idp.rsaKey.E)).Bytes()),
+			},
+			{
+				"kty": "EC",
+				"kid": "ec",
+				"use": "sig",
+				"crv": "P-256",
+				"x":   b64(idp.ecKey.X.FillBytes(make([]byte, 32))),
+				"y":   b64(idp.ecKey.Y.FillBytes(make([]byte, 32))),
+			},
+		},
+	})
+}
+
+// authorize stands for the login of the user at the provider: it returns the code which the
+// provider would send to the redirect URL, bound to the PKCE challenge of the login URL.
+func (idp *testIdP) authorize(t *testing.T, authURL, idToken string) string {
+	t.Helper()
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := RandomString()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp.mu.Lock()
+	idp.codes[code] = testCode{challenge: u.Query().Get("code_challenge"), idToken: idToken}
+	idp.mu.Unlock()
+
+	return code
+}
+
+func (idp *testIdP) token(w http.ResponseWriter, r *http.Request) {
+	tokenError := func(status int, code string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+
+	clientID, secret, ok := r.BasicAuth()
+	if !ok || clientID != testClientID || secret != testClientSecret {
+		tokenError(http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	if r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != testRedirectURL {
+		tokenError(http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	idp.mu.Lock()
+	code, found := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	idp.mu.Unlock()
+
+	if !found || CodeChallenge(r.PostFormValue("code_verifier")) != code.challenge {
+		tokenError(http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"id_token": code.idToken, "token_type": "Bearer"})
+}
+
+// claims returns valid claims for the nonce, which the tests alter.
+func (idp *testIdP) claims(nonce string) map[string]interface{} {
+	now := time.Now()
+
+	return map[string]interface{}{
+		"iss":            idp.issuer(),
+		"sub":            "248289761001",
+		"aud":            testClientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+	}
+}
+
+// sign returns the JWT of the claims signed with the algorithm: RS256 and ES256 with the keys of
+// the JWKS, HS256 with the RSA public key as secret (the key confusion attack) and none unsigned.
+func (idp *testIdP) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	t.Helper()
+
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	signingInput := encode(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encode(claims)
+	hash := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+
+	switch alg {
+	case "RS256":
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, idp.rsaKey, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, idp.ecKey, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case "HS256":
+		mac := hmac.New(sha256.New, x509.MarshalPKCS1PublicKey(&idp.rsaKey.PublicKey))
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	idp := newTestIdP(t)
+
+	authURL, err := idp.provider().AuthCodeURL(context.Background(), "the-state", "the-nonce", CodeChallenge("the-verifier"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := u.Scheme + "://" + u.Host + u.Path; got != idp.issuer()+"/authorize" {
+		t.Errorf("got endpoint %s, want the authorization endpoint of the metadata", got)
+	}
+
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          testRedirectURL,
+		"scope":                 "openid email",
+		"state":                 "the-state",
+		"nonce":                 "the-nonce",
+		"code_challenge":        CodeChallenge("the-verifier"),
+		"code_challenge_method": "S256",
+	}
+
+	for name, value := range want {
+		if got := u.Query().Get(name); got != value {
+			t.Errorf("%s: got %q, want %q", name, got, value)
+		}
+	}
+}
+
+// TestCodeChallenge checks the S256 challenge against the example of RFC 7636 Appendix B.
+func TestCodeChallenge(t *testing.T) {
+	got := CodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if want := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestExchangePKCE(t *testing.T) {
+	idp := newTestIdP(t)
+	provider := idp.provider()
+	ctx := context.Background()
+
+	verifier, err := RandomString()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, err := provider.AuthCodeURL(ctx, "state", "nonce", CodeChallenge(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("wrong verifier", func(t *testing.T) {
+		code := idp.authorize(t, authURL, "the-id-token")
+
+		_, err := provider.Exchange(ctx, code, verifier+"x")
+		if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+			t.Fatalf("got error %v, want invalid_grant", err)
+		}
+	})
+
+	t.Run("right verifier", func(t *testing.T) {
+		code := idp.authorize(t, authURL, "the-id-token")
+
+		idToken, err := provider.Exchange(ctx, code, verifier)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if idToken != "the-id-token" {
+			t.Errorf("got id token %q", idToken)
+		}
+
+		// The codes can only be used once.
+		_, err = provider.Exchange(ctx, code, verifier)
+		if err == nil {
+			t.Error("code exchanged twice")
+		}
+	})
+
+	t.Run("wrong client secret", func(t *testing.T) {
+		code := idp.authorize(t, authURL, "the-id-token")
+
+		other := NewProvider(Config{
+			Issuer:       idp.issuer(),
+			ClientID:     testClientID,
+			ClientSecret: "wrong",
+			RedirectURL:  testRedirectURL,
+		}, idp.server.Client())
+
+		_, err := other.Exchange(ctx, code, verifier)
+		if err == nil || !strings.Contains(err.Error(), "invalid_client") {
+			t.Fatalf("got error %v, want invalid_client", err)
+		}
+	})
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp := newTestIdP(t)
+	provider := idp.provider()
+	ctx := context.Background()
+
+	const nonce = "the-nonce"
+
+	with := func(name string, value interface{}) map[string]interface{} {
+		claims := idp.claims(nonce)
+		claims[name] = value
+		return claims
+	}
+
+	// An audience list is only valid with the azp claim of the client.
+	azpClaims := with("aud", []string{testClientID, "other"})
+	azpClaims["azp"] = testClientID
+
+	// A tampered payload invalidates the signature.
+	parts := strings.Split(idp.sign(t, "RS256", "rsa", idp.claims(nonce)), ".")
+	tampered, _ := json.Marshal(with("email", "mallory@example.com"))
+	parts[1] = base64.RawURLEncoding.EncodeToString(tampered)
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"RS256", idp.sign(t, "RS256", "rsa", idp.claims(nonce)), true},
+		{"ES256", idp.sign(t, "ES256", "ec", idp.claims(nonce)), true},
+		{"audience list", idp.sign(t, "RS256", "rsa", azpClaims), true},
+		{"audience list without azp", idp.sign(t, "RS256", "rsa", with("aud", []string{testClientID, "other"})), false},
+		{"wrong issuer", idp.sign(t, "RS256", "rsa", with("iss", "https://evil.example.com")), false},
+		{"wrong audience", idp.sign(t, "RS256", "rsa", with("aud", "other-client")), false},
+		{"wrong nonce", idp.sign(t, "RS256", "rsa", with("nonce", "other-nonce")), false},
+		{"missing nonce", idp.sign(t, "RS256", "rsa", with("nonce", "")), false},
+		{"expired", idp.sign(t, "RS256", "rsa", with("exp", time.Now().Add(-2*time.Minute).Unix())), false},
+		{"issued in the future", idp.sign(t, "RS256", "rsa", with("iat", time.Now().Add(2*time.Minute).Unix())), false},
+		{"missing subject", idp.sign(t, "RS256", "rsa", with("sub", "")), false},
+		{"alg none", idp.sign(t, "none", "rsa", idp.claims(nonce)), false},
+		{"alg HS256 with the public key", idp.sign(t, "HS256", "rsa", idp.claims(nonce)), false},
+		{"RS256 header with the EC key", idp.sign(t, "RS256", "ec", idp.claims(nonce)), false},
+		{"unknown key", idp.sign(t, "RS256", "unknown", idp.claims(nonce)), false},
+		{"tampered payload", strings.Join(parts, "."), false},
+		{"malformed", "not.a-token", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := provider.VerifyIDToken(ctx, tt.token, nonce)
+
+			if !tt.valid {
+				if !errors.Is(err, ErrInvalidIDToken) {
+					t.Fatalf("got error %v, want ErrInvalidIDToken", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if claims.Subject != "248289761001" || claims.Email != "alice@example.com" || !bool(claims.EmailVerified) {
+				t.Errorf("unexpected claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	idp := newTestIdP(t)
+
+	// The provider must publish the configured issuer, with the same trailing slash.
+	provider := NewProvider(Config{Issuer: idp.issuer() + "/", ClientID: testClientID}, idp.server.Client())
+
+	_, err := provider.Metadata(context.Background())
+	if err == nil {
+		t.Fatal("metadata of another issuer accepted")
+	}
+}
@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// FallbackStore struct wraps a shared store and falls back to a local store when the shared one
+// fails, e.g. while the database is unavailable: the limits are then only applied per instance,
+// which is better than either rejecting or allowing all the requests. After a failure the shared
+// store isn't tried again for retryAfter, so that the requests don't all wait on its timeout.
+type FallbackStore struct {
+	primary    Store
+	fallback   Store
+	retryAfter time.Duration
+	onError    func(error)
+
+	mu        sync.Mutex
+	downUntil time.Time
+}
+
+// NewFallbackStore function returns a FallbackStore. onError is called with the error of the
+// primary store when it fails, at most once per retryAfter rather than on every request.
+func NewFallbackStore(primary, fallback Store, retryAfter time.Duration, onError func(error)) *FallbackStore {
+	return &FallbackStore{
+		primary:    primary,
+		fallback:   fallback,
+		retryAfter: retryAfter,
+		onError:    onError,
+	}
+}
+
+// Allow counts a request of key against limit in the primary store, or in the fallback store
+// when the primary one is down.
+func (s *FallbackStore) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	if s.primaryDown() {
+		return s.fallback.Allow(ctx, key, limit)
+	}
+
+	result, err := s.primary.Allow(ctx, key, limit)
+	if err != nil {
+		// A request cancelled by the client doesn't mean that the primary store is down.
+		if ctx.Err() == nil {
+			s.markDown(err)
+		}
+		return s.fallback.Allow(ctx, key, limit)
+	}
+
+	return result, nil
+}
+
+func (s *FallbackStore) primaryDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return time.Now().Before(s.downUntil)
+}
+
+func (s *FallbackStore) markDown(err error) {
+	s.mu.Lock()
+	s.downUntil = time.Now().Add(s.retryAfter)
+	s.mu.Unlock()
+
+	s.onError(err)
+}
+
+// Snapshot returns the state of the keys in the primary store, or in the fallback store when
+// the primary one is down.
+func (s *FallbackStore) Snapshot(ctx context.Context) ([]KeyInfo, error) {
+	if !s.primaryDown() {
+		keys, err := s.primary.Snapshot(ctx)
+		if err == nil {
+			return keys, nil
+		}
+	}
+
+	return s.fallback.Snapshot(ctx)
+}
+
+// Close closes both stores.
+func (s *FallbackStore) Close() error {
+	err := s.primary.Close()
+	if ferr := s.fallback.Close(); err == nil {
+		err = ferr
+	}
+
+	return err
+}
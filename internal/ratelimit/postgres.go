@@ -0,0 +1,161 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// PostgresStore struct holds the state of the limits in the rate_limits table, so that it is
+// shared by all the instances of the API. The table is UNLOGGED: losing the state on a crash of
+// the database only resets the limits.
+type PostgresStore struct {
+	db      *sql.DB
+	timeout time.Duration
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// NewPostgresStore function returns a PostgresStore and starts the background goroutine deleting
+// the keys whose limit is fully replenished, which are equivalent to missing keys. Each query is
+// given timeout to complete.
+func NewPostgresStore(db *sql.DB, timeout time.Duration) *PostgresStore {
+	s := &PostgresStore{
+		db:      db,
+		timeout: timeout,
+		stop:    make(chan struct{}),
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.deleteReplenished()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *PostgresStore) deleteReplenished() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Errors are ignored, the next run deletes the keys.
+	s.db.ExecContext(ctx, `DELETE FROM rate_limits WHERE tat < clock_timestamp()`)
+}
+
+// Allow counts a request of key against limit. The row of the key is locked for the duration of
+// the transaction so that the concurrent requests of the key, from any instance, are applied one
+// after the other. The clock of the database is used so that the instances agree on the time.
+func (s *PostgresStore) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Result{}, err
+	}
+	defer tx.Rollback()
+
+	// Create the row of a new key with a tat of now, so that the limit is fully replenished.
+	query := `
+		INSERT INTO rate_limits (key, tat, rate, burst, last_seen)
+		VALUES ($1, clock_timestamp(), $2, $3, clock_timestamp())
+		ON CONFLICT (key) DO NOTHING`
+
+	_, err = tx.ExecContext(ctx, query, key, limit.Rate, limit.Burst)
+	if err != nil {
+		return Result{}, err
+	}
+
+	query = `
+		SELECT tat, clock_timestamp()
+		FROM rate_limits
+		WHERE key = $1
+		FOR UPDATE`
+
+	var tat, now time.Time
+
+	err = tx.QueryRowContext(ctx, query, key).Scan(&tat, &now)
+	if err != nil {
+		return Result{}, err
+	}
+
+	result, tat := gcra(now, tat, limit)
+
+	rejected := 0
+	if !result.Allowed {
+		rejected = 1
+	}
+
+	query = `
+		UPDATE rate_limits
+		SET tat = $2, rate = $3, burst = $4, last_seen = $5, rejected = rejected + $6
+		WHERE key = $1`
+
+	_, err = tx.ExecContext(ctx, query, key, tat, limit.Rate, limit.Burst, now, rejected)
+	if err != nil {
+		return Result{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Result{}, err
+	}
+
+	return result, nil
+}
+
+// Snapshot returns the state of the 1000 most recently seen keys.
+func (s *PostgresStore) Snapshot(ctx context.Context) ([]KeyInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	query := `
+		SELECT key, tat, rate, burst, last_seen, rejected, clock_timestamp()
+		FROM rate_limits
+		ORDER BY last_seen DESC
+		LIMIT 1000`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []KeyInfo{}
+
+	for rows.Next() {
+		var (
+			info     KeyInfo
+			tat, now time.Time
+		)
+
+		err := rows.Scan(&info.Key, &tat, &info.Rate, &info.Burst, &info.LastSeen, &info.Rejected, &now)
+		if err != nil {
+			return nil, err
+		}
+
+		info.Remaining = remaining(now, tat, Limit{Rate: info.Rate, Burst: info.Burst})
+		keys = append(keys, info)
+	}
+
+	return keys, rows.Err()
+}
+
+// Close stops the background goroutine. The database connection pool isn't closed.
+func (s *PostgresStore) Close() error {
+	s.once.Do(func() {
+		close(s.stop)
+	})
+
+	return nil
+}
@@ -0,0 +1,212 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Limit struct defines a rate limit: Rate requests per second on average, with bursts of up to
+// Burst requests.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// emissionInterval returns the time between two requests at the average rate.
+func (l Limit) emissionInterval() time.Duration {
+	return time.Duration(float64(time.Second) / l.Rate)
+}
+
+// Store interface is implemented by the backends holding the state of the limits. The state can
+// be kept in process memory (MemoryStore), or in a shared store (PostgresStore) so that the
+// limits apply across all the instances of the API.
+type Store interface {
+	// Allow counts a request of key against limit.
+	Allow(ctx context.Context, key string, limit Limit) (Result, error)
+	// Snapshot returns the state of all the keys, the most recently seen first.
+	Snapshot(ctx context.Context) ([]KeyInfo, error)
+	// Close stops the background goroutines of the store.
+	Close() error
+}
+
+// Result struct holds the outcome of a request against a limit. Remaining is the number of
+// requests which would be allowed right now, ResetAfter is how long until the limit is fully
+// replenished and RetryAfter, when the request is denied, how long until the next one is allowed.
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	ResetAfter time.Duration
+	RetryAfter time.Duration
+}
+
+// gcra function applies the generic cell rate algorithm: tat is the theoretical arrival time of
+// the next request, the stored state of the key. It returns the result and the new tat, which is
+// unchanged when the request is denied. An equivalent of a token bucket which only needs a single
+// timestamp per key.
+func gcra(now, tat time.Time, limit Limit) (Result, time.Time) {
+	interval := limit.emissionInterval()
+	tolerance := interval * time.Duration(limit.Burst)
+
+	if tat.Before(now) {
+		tat = now
+	}
+
+	newTAT := tat.Add(interval)
+	allowAt := newTAT.Add(-tolerance)
+
+	if now.Before(allowAt) {
+		return Result{
+			Allowed:    false,
+			Limit:      limit.Burst,
+			Remaining:  0,
+			ResetAfter: tat.Sub(now),
+			RetryAfter: allowAt.Sub(now),
+		}, tat
+	}
+
+	remaining := int(math.Floor(float64(now.Sub(allowAt)) / float64(interval)))
+
+	return Result{
+		Allowed:    true,
+		Limit:      limit.Burst,
+		Remaining:  remaining,
+		ResetAfter: newTAT.Sub(now),
+	}, newTAT
+}
+
+// entry struct holds the state of a key in the MemoryStore.
+type entry struct {
+	tat      time.Time
+	limit    Limit
+	lastSeen time.Time
+	rejected int64
+}
+
+// MemoryStore struct holds the state of the limits in process memory.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*entry
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// NewMemoryStore function returns an empty MemoryStore and starts the background goroutine
+// removing the keys which haven't been seen for idleTimeout.
+func NewMemoryStore(idleTimeout time.Duration) *MemoryStore {
+	s := &MemoryStore{
+		entries: make(map[string]*entry),
+		stop:    make(chan struct{}),
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.removeIdle(idleTimeout)
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *MemoryStore) removeIdle(idleTimeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, e := range s.entries {
+		if time.Since(e.lastSeen) > idleTimeout {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// Allow counts a request of key against limit. It never fails.
+func (s *MemoryStore) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, found := s.entries[key]
+	if !found {
+		e = &entry{}
+		s.entries[key] = e
+	}
+
+	result, tat := gcra(now, e.tat, limit)
+
+	e.tat = tat
+	e.limit = limit
+	e.lastSeen = now
+	if !result.Allowed {
+		e.rejected++
+	}
+
+	return result, nil
+}
+
+// Close stops the background cleanup goroutine.
+func (s *MemoryStore) Close() error {
+	s.once.Do(func() {
+		close(s.stop)
+	})
+
+	return nil
+}
+
+// KeyInfo struct describes the state of a key, for inspection.
+type KeyInfo struct {
+	Key       string    `json:"key"`
+	Rate      float64   `json:"rate"`
+	Burst     int       `json:"burst"`
+	Remaining int       `json:"remaining"`
+	LastSeen  time.Time `json:"last_seen"`
+	Rejected  int64     `json:"rejected"`
+}
+
+// Snapshot returns the state of all the keys, the most recently seen first.
+func (s *MemoryStore) Snapshot(ctx context.Context) ([]KeyInfo, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]KeyInfo, 0, len(s.entries))
+	for key, e := range s.entries {
+		keys = append(keys, KeyInfo{
+			Key:       key,
+			Rate:      e.limit.Rate,
+			Burst:     e.limit.Burst,
+			Remaining: remaining(now, e.tat, e.limit),
+			LastSeen:  e.lastSeen,
+			Rejected:  e.rejected,
+		})
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].LastSeen.After(keys[j].LastSeen)
+	})
+
+	return keys, nil
+}
+
+// remaining returns the number of requests which would be allowed right now.
+func remaining(now, tat time.Time, limit Limit) int {
+	// Evaluate a request without storing it: if it's allowed, it is one of the remaining ones.
+	result, _ := gcra(now, tat, limit)
+	if !result.Allowed {
+		return 0
+	}
+
+	return result.Remaining + 1
+}
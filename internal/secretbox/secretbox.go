@@ -0,0 +1,66 @@
+package secretbox
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+)
+
+// ErrInvalidCiphertext is returned by Open() when the ciphertext is truncated, has been tampered
+// with or was sealed with another key.
+var ErrInvalidCiphertext = errors.New("secretbox: invalid ciphertext")
+
+// Box struct encrypts the secrets stored in the database, e.g. the TOTP secrets which, unlike the
+// passwords, must be readable by the application and so can't be hashed. AES-256-GCM is used,
+// with a random nonce prepended to each ciphertext.
+type Box struct {
+	aead cipher.AEAD
+}
+
+// New function returns a Box using the key, which must be 32 bytes long.
+func New(key []byte) (*Box, error) {
+	if len(key) != 32 {
+		return nil, errors.New("secretbox: the key must be 32 bytes long")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Box{aead: aead}, nil
+}
+
+// Seal method encrypts and authenticates the plaintext.
+func (b *Box) Seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Open method decrypts a ciphertext returned by Seal().
+func (b *Box) Open(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < b.aead.NonceSize() {
+		return nil, ErrInvalidCiphertext
+	}
+
+	nonce, sealed := ciphertext[:b.aead.NonceSize()], ciphertext[b.aead.NonceSize():]
+
+	plaintext, err := b.aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,216 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ServerConfig function returns a TLS configuration with modern defaults: TLS 1.2 or later, only
+// AEAD cipher suites with forward secrecy, and HTTP/2 negotiated with ALPN. The certificate is
+// served by reloader. When the reloader has a client CA file the clients may present a
+// certificate, which must then be signed by one of its CAs: the internal callers authenticate with
+// a certificate while the public clients don't. Each handshake uses the current CAs.
+func ServerConfig(reloader *CertReloader) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// The TLS 1.3 cipher suites aren't configurable, this list only applies to TLS 1.2.
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		NextProtos:       []string{"h2", "http/1.1"},
+		GetCertificate:   reloader.GetCertificate,
+	}
+
+	if reloader.clientCAFile != "" {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			clientCfg := cfg.Clone()
+			clientCfg.ClientCAs = reloader.ClientCAs()
+			return clientCfg, nil
+		}
+	}
+
+	return cfg
+}
+
+// LoadCertPool function returns a pool holding the PEM encoded certificates of the file.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("%s: no PEM encoded certificate found", file)
+	}
+
+	return pool, nil
+}
+
+// Identity function returns the service identity of a client certificate: its first URI SAN
+// (e.g. spiffe://greenlight/billing) or, if there is none, its subject common name.
+func Identity(cert *x509.Certificate) string {
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+
+	return cert.Subject.CommonName
+}
+
+// CertReloader struct holds a certificate and its key loaded from files, and optionally the CAs
+// verifying the client certificates, and reloads them when the files change on disk, e.g. when
+// they are renewed.
+type CertReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTime   time.Time
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// NewCertReloader function loads the certificate and the key, and the client CAs unless
+// clientCAFile is empty. They must be valid, the reloads later on keep the previous ones when
+// they fail.
+func NewCertReloader(certFile, keyFile, clientCAFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		stop:         make(chan struct{}),
+	}
+
+	_, err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetCertificate returns the current certificate. It is meant for tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// ClientCAs returns the current pool of the client CAs, nil if there is no client CA file.
+func (r *CertReloader) ClientCAs() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.clientCAs
+}
+
+// Reload loads the certificate, the key and the client CAs if one of the files changed since the
+// last load. It returns true when they have been replaced.
+func (r *CertReloader) Reload() (bool, error) {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+
+	modTime, err := latestModTime(files...)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	unchanged := r.cert != nil && modTime.Equal(r.modTime)
+	r.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	var clientCAs *x509.CertPool
+	if r.clientCAFile != "" {
+		clientCAs, err = LoadCertPool(r.clientCAFile)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTime = modTime
+	r.mu.Unlock()
+
+	return true, nil
+}
+
+// Watch checks the files every interval until Stop() is called. onReload is called after each
+// reload attempt which replaced the files or failed. The certificate and the key are often
+// not replaced at the same time, a failure is retried on the next check.
+func (r *CertReloader) Watch(interval time.Duration, onReload func(error)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				reloaded, err := r.Reload()
+				if reloaded || err != nil {
+					onReload(err)
+				}
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops watching the files.
+func (r *CertReloader) Stop() {
+	r.once.Do(func() {
+		close(r.stop)
+	})
+}
+
+// latestModTime returns the most recent modification time of the files.
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if info.IsDir() {
+			return time.Time{}, errors.New(file + " is a directory")
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
@@ -0,0 +1,457 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert struct holds a self-signed or CA signed certificate generated for a test.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert function signs the template with the parent, or self-signs it if parent is nil.
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// newServerCert function returns a self-signed certificate for 127.0.0.1.
+func newServerCert(t *testing.T, commonName string) *testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, nil)
+}
+
+// newCA function returns a self-signed CA certificate.
+func newCA(t *testing.T) *testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}, nil)
+}
+
+// newClientCert function returns a client certificate signed by the CA, with the URI SAN if
+// uri isn't empty.
+func newClientCert(t *testing.T, ca *testCert, commonName, uri string) *testCert {
+	t.Helper()
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	if uri != "" {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = []*url.URL{u}
+	}
+
+	return newTestCert(t, template, ca)
+}
+
+// writeFiles writes the certificate and its key, with the given modification time.
+func (c *testCert) writeFiles(t *testing.T, certFile, keyFile string, modTime time.Time) {
+	t.Helper()
+
+	for file, content := range map[string][]byte{certFile: c.certPEM, keyFile: c.keyPEM} {
+		err := os.WriteFile(file, content, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.Chtimes(file, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+// servedCommonName returns the common name of the certificate currently served by the reloader.
+func servedCommonName(t *testing.T, reloader *CertReloader) string {
+	t.Helper()
+
+	cert, err := reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloaderReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+
+	newServerCert(t, "first").writeFiles(t, certFile, keyFile, start)
+
+	reloader, err := NewCertReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := servedCommonName(t, reloader); got != "first" {
+		t.Fatalf("got certificate %q, want first", got)
+	}
+
+	reloaded, err := reloader.Reload()
+	if err != nil || reloaded {
+		t.Fatalf("unchanged files: got reloaded %t, error %v", reloaded, err)
+	}
+
+	newServerCert(t, "second").writeFiles(t, certFile, keyFile, start.Add(time.Minute))
+
+	reloaded, err = reloader.Reload()
+	if err != nil || !reloaded {
+		t.Fatalf("changed files: got reloaded %t, error %v", reloaded, err)
+	}
+
+	if got := servedCommonName(t, reloader); got != "second" {
+		t.Fatalf("got certificate %q, want second", got)
+	}
+
+	// A key which doesn't match the certificate, e.g. while the files are being replaced one
+	// at a time, is an error and the previous certificate is kept.
+	err = os.WriteFile(certFile, newServerCert(t, "third").certPEM, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(certFile, start.Add(2*time.Minute), start.Add(2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = reloader.Reload()
+	if err == nil {
+		t.Fatal("mismatched certificate and key: got no error")
+	}
+
+	if got := servedCommonName(t, reloader); got != "second" {
+		t.Fatalf("got certificate %q after a failed reload, want second", got)
+	}
+}
+
+func TestCertReloaderWatch(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+
+	newServerCert(t, "first").writeFiles(t, certFile, keyFile, start)
+
+	reloader, err := NewCertReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloader.Stop()
+
+	reloads := make(chan error, 10)
+	reloader.Watch(10*time.Millisecond, func(err error) {
+		reloads <- err
+	})
+
+	newServerCert(t, "renewed").writeFiles(t, certFile, keyFile, start.Add(time.Minute))
+
+	select {
+	case err := <-reloads:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the renewed certificate wasn't reloaded")
+	}
+
+	if got := servedCommonName(t, reloader); got != "renewed" {
+		t.Fatalf("got certificate %q, want renewed", got)
+	}
+}
+
+// testServer struct describes a server started by startTLSServer().
+type testServer struct {
+	addr         string
+	reloader     *CertReloader
+	clientCAFile string
+}
+
+// startTLSServer starts an HTTPS server with ServerConfig() which responds with the identity of
+// the verified client certificate, or "anonymous". The client certificates are verified with
+// clientCA, unless it is nil.
+func startTLSServer(t *testing.T, server *testCert, clientCA *testCert) *testServer {
+	t.Helper()
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	server.writeFiles(t, certFile, keyFile, time.Now().Add(-time.Hour))
+
+	clientCAFile := ""
+	if clientCA != nil {
+		clientCAFile = filepath.Join(dir, "client-ca.pem")
+		writeCAFile(t, clientCAFile, clientCA, time.Now().Add(-time.Hour))
+	}
+
+	reloader, err := NewCertReloader(certFile, keyFile, clientCAFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{
+		TLSConfig: ServerConfig(reloader),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity := "anonymous"
+			if len(r.TLS.VerifiedChains) > 0 {
+				identity = Identity(r.TLS.VerifiedChains[0][0])
+			}
+			io.WriteString(w, identity)
+		}),
+		// The rejected handshakes are expected, don't log them.
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+
+	go srv.ServeTLS(ln, "", "")
+	t.Cleanup(func() { srv.Close() })
+
+	return &testServer{addr: ln.Addr().String(), reloader: reloader, clientCAFile: clientCAFile}
+}
+
+// writeCAFile writes the certificate of the CA, with the given modification time.
+func writeCAFile(t *testing.T, file string, ca *testCert, modTime time.Time) {
+	t.Helper()
+
+	err := os.WriteFile(file, ca.certPEM, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chtimes(file, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// get requests the server with the client certificate, if any, and returns the response body.
+func get(t *testing.T, addr string, server *testCert, client *testCert) (string, error) {
+	t.Helper()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.cert)
+
+	// The certificate is sent even if the server doesn't list its issuer in the acceptable CAs,
+	// like a client trying its luck would do.
+	tlsConfig := &tls.Config{RootCAs: roots}
+	if client != nil {
+		cert := client.tlsCertificate(t)
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &cert, nil
+		}
+	}
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		Timeout:   5 * time.Second,
+	}
+	defer httpClient.CloseIdleConnections()
+
+	resp, err := httpClient.Get("https://" + addr + "/")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestServerConfigClientCertificates(t *testing.T) {
+	ca := newCA(t)
+	server := newServerCert(t, "server")
+
+	addr := startTLSServer(t, server, ca).addr
+
+	tests := []struct {
+		name    string
+		client  *testCert
+		want    string
+		wantErr bool
+	}{
+		{"no certificate", nil, "anonymous", false},
+		{"URI SAN identity", newClientCert(t, ca, "billing", "spiffe://greenlight/billing"), "spiffe://greenlight/billing", false},
+		{"common name identity", newClientCert(t, ca, "reporting", ""), "reporting", false},
+		{"certificate of another CA", newClientCert(t, newCA(t), "intruder", "spiffe://greenlight/intruder"), "", true},
+		{"self-signed certificate", newServerCert(t, "self-signed"), "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := get(t, addr, server, tt.client)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got response %q, want a handshake error", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("got identity %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestServerConfigClientCARotation checks that the handshakes use the client CAs reloaded from
+// the file.
+func TestServerConfigClientCARotation(t *testing.T) {
+	oldCA, rotatedCA := newCA(t), newCA(t)
+	server := newServerCert(t, "server")
+
+	srv := startTLSServer(t, server, oldCA)
+
+	oldClient := newClientCert(t, oldCA, "billing", "spiffe://greenlight/billing")
+	rotatedClient := newClientCert(t, rotatedCA, "billing", "spiffe://greenlight/billing")
+
+	if _, err := get(t, srv.addr, server, rotatedClient); err == nil {
+		t.Fatal("certificate of the rotated CA accepted before the rotation")
+	}
+
+	writeCAFile(t, srv.clientCAFile, rotatedCA, time.Now())
+
+	reloaded, err := srv.reloader.Reload()
+	if err != nil || !reloaded {
+		t.Fatalf("rotated CA: got reloaded %t, error %v", reloaded, err)
+	}
+
+	got, err := get(t, srv.addr, server, rotatedClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != "spiffe://greenlight/billing" {
+		t.Errorf("got identity %q, want spiffe://greenlight/billing", got)
+	}
+
+	if _, err := get(t, srv.addr, server, oldClient); err == nil {
+		t.Error("certificate of the old CA accepted after the rotation")
+	}
+}
+
+func TestServerConfigWithoutClientCA(t *testing.T) {
+	ca := newCA(t)
+	server := newServerCert(t, "server")
+
+	addr := startTLSServer(t, server, nil).addr
+
+	// The client certificates aren't requested, so they can't give an identity.
+	got, err := get(t, addr, server, newClientCert(t, ca, "billing", "spiffe://greenlight/billing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != "anonymous" {
+		t.Errorf("got identity %q, want anonymous", got)
+	}
+}
+
+func TestServerConfigRejectsOldTLSVersions(t *testing.T) {
+	server := newServerCert(t, "server")
+	addr := startTLSServer(t, server, nil).addr
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.cert)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, MaxVersion: tls.VersionTLS11})
+	if err == nil {
+		conn.Close()
+		t.Fatal("TLS 1.1 handshake succeeded")
+	}
+}
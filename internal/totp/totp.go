@@ -0,0 +1,141 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Algorithm is the HMAC hash function of the codes.
+type Algorithm string
+
+const (
+	SHA1   Algorithm = "SHA1"
+	SHA256 Algorithm = "SHA256"
+	SHA512 Algorithm = "SHA512"
+)
+
+// newHash returns the constructor of the hash function.
+func (a Algorithm) newHash() func() hash.Hash {
+	switch a {
+	case SHA256:
+		return sha256.New
+	case SHA512:
+		return sha512.New
+	default:
+		return sha1.New
+	}
+}
+
+// Options struct holds the parameters of the codes, which the authenticator apps must share.
+type Options struct {
+	Period    time.Duration
+	Digits    int
+	Algorithm Algorithm
+}
+
+// DefaultOptions are the parameters supported by all the authenticator apps: a code of 6 digits
+// every 30 seconds, with HMAC-SHA1.
+var DefaultOptions = Options{
+	Period:    30 * time.Second,
+	Digits:    6,
+	Algorithm: SHA1,
+}
+
+// GenerateSecret function returns a new random secret of 20 bytes, the size of a SHA-1 hash as
+// recommended by RFC 4226.
+func GenerateSecret() ([]byte, error) {
+	secret := make([]byte, 20)
+
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// EncodeSecret function returns the secret encoded in base32 without padding, as entered in
+// the authenticator apps.
+func EncodeSecret(secret []byte) string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+}
+
+// Counter method returns the time step of t: the number of periods since the Unix epoch.
+func (o Options) Counter(t time.Time) int64 {
+	return t.Unix() / int64(o.Period/time.Second)
+}
+
+// Code method returns the code of the secret at t (RFC 6238).
+func (o Options) Code(secret []byte, t time.Time) string {
+	return o.hotp(secret, o.Counter(t))
+}
+
+// hotp method returns the HOTP code of the secret for the counter (RFC 4226): the HMAC of the
+// counter is dynamically truncated to 31 bits, then to the number of digits.
+func (o Options) hotp(secret []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(o.Algorithm.newHash(), secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := int64(binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff)
+
+	modulo := int64(1)
+	for i := 0; i < o.Digits; i++ {
+		modulo *= 10
+	}
+
+	return fmt.Sprintf("%0*d", o.Digits, value%modulo)
+}
+
+// Validate method checks the code against the codes of the secret at t and of the skew periods
+// before and after it, which allows for the clock drift of the device and the time taken to type
+// the code. It returns the time step of the matching code, which the caller must store and only
+// accept greater ones from then on so that a code can't be replayed.
+func (o Options) Validate(secret []byte, code string, t time.Time, skew int) (int64, bool) {
+	if len(code) != o.Digits {
+		return 0, false
+	}
+
+	counter := o.Counter(t)
+
+	for i := -skew; i <= skew; i++ {
+		expected := o.hotp(secret, counter+int64(i))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter + int64(i), true
+		}
+	}
+
+	return 0, false
+}
+
+// URI method returns the otpauth:// URI of the secret, usually shown as a QR code, which the
+// authenticator apps use to register the account, e.g.
+// otpauth://totp/Greenlight:alice@example.com?secret=...&issuer=Greenlight.
+func (o Options) URI(issuer, account string, secret []byte) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+
+	params := url.Values{}
+	params.Set("secret", EncodeSecret(secret))
+	params.Set("issuer", issuer)
+	params.Set("algorithm", string(o.Algorithm))
+	params.Set("digits", fmt.Sprint(o.Digits))
+	params.Set("period", fmt.Sprint(int64(o.Period/time.Second)))
+
+	// url.Values encodes the spaces as "+", which the apps display as is.
+	return "otpauth://totp/" + label + "?" + strings.ReplaceAll(params.Encode(), "+", "%20")
+}
@@ -0,0 +1,130 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The seeds of the RFC 6238 test vectors: the ASCII digits "1234567890" repeated up to the size
+// of the hash of each algorithm.
+var rfcSeeds = map[Algorithm][]byte{
+	SHA1:   []byte(strings.Repeat("1234567890", 2)),
+	SHA256: []byte(strings.Repeat("1234567890", 4)[:32]),
+	SHA512: []byte(strings.Repeat("1234567890", 7)[:64]),
+}
+
+// TestCodeRFC6238 checks the codes against the test vectors of RFC 6238 Appendix B.
+func TestCodeRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want map[Algorithm]string
+	}{
+		{59, map[Algorithm]string{SHA1: "94287082", SHA256: "46119246", SHA512: "90693936"}},
+		{1111111109, map[Algorithm]string{SHA1: "07081804", SHA256: "68084774", SHA512: "25091201"}},
+		{1111111111, map[Algorithm]string{SHA1: "14050471", SHA256: "67062674", SHA512: "99943326"}},
+		{1234567890, map[Algorithm]string{SHA1: "89005924", SHA256: "91819424", SHA512: "93441116"}},
+		{2000000000, map[Algorithm]string{SHA1: "69279037", SHA256: "90698825", SHA512: "38618901"}},
+		{20000000000, map[Algorithm]string{SHA1: "65353130", SHA256: "77737706", SHA512: "47863826"}},
+	}
+
+	for _, tt := range tests {
+		for _, algorithm := range []Algorithm{SHA1, SHA256, SHA512} {
+			opts := Options{Period: 30 * time.Second, Digits: 8, Algorithm: algorithm}
+
+			got := opts.Code(rfcSeeds[algorithm], time.Unix(tt.unix, 0))
+			if got != tt.want[algorithm] {
+				t.Errorf("%s at %d: got %s, want %s", algorithm, tt.unix, got, tt.want[algorithm])
+			}
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	secret := rfcSeeds[SHA1]
+	now := time.Unix(1234567890, 0)
+	opts := DefaultOptions
+
+	tests := []struct {
+		name   string
+		offset time.Duration
+		skew   int
+		valid  bool
+	}{
+		{"current period", 0, 1, true},
+		{"previous period within skew", -30 * time.Second, 1, true},
+		{"next period within skew", 30 * time.Second, 1, true},
+		{"two periods before with skew 1", -60 * time.Second, 1, false},
+		{"two periods after with skew 1", 60 * time.Second, 1, false},
+		{"two periods before with skew 2", -60 * time.Second, 2, true},
+		{"previous period without skew", -30 * time.Second, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := opts.Code(secret, now.Add(tt.offset))
+
+			counter, ok := opts.Validate(secret, code, now, tt.skew)
+			if ok != tt.valid {
+				t.Fatalf("got valid %t, want %t", ok, tt.valid)
+			}
+
+			if ok && counter != opts.Counter(now.Add(tt.offset)) {
+				t.Errorf("got counter %d, want the time step of the code %d", counter, opts.Counter(now.Add(tt.offset)))
+			}
+		})
+	}
+}
+
+func TestValidateRejectsMalformedCodes(t *testing.T) {
+	secret := rfcSeeds[SHA1]
+	now := time.Unix(1234567890, 0)
+	code := DefaultOptions.Code(secret, now)
+
+	for _, bad := range []string{"", code[:5], code + "0", "abcdef"} {
+		if _, ok := DefaultOptions.Validate(secret, bad, now, 1); ok {
+			t.Errorf("code %q: got valid", bad)
+		}
+	}
+}
+
+// TestValidateReplay checks that the returned time step lets the caller reject a code which was
+// already used, including the code of an earlier period still accepted by the skew.
+func TestValidateReplay(t *testing.T) {
+	secret := rfcSeeds[SHA1]
+	now := time.Unix(1234567890, 0)
+	opts := DefaultOptions
+
+	// accept mimics the caller: only the time steps greater than the last used one are accepted.
+	var lastCounter int64
+	accept := func(code string, at time.Time) bool {
+		counter, ok := opts.Validate(secret, code, at, 1)
+		if !ok || counter <= lastCounter {
+			return false
+		}
+		lastCounter = counter
+		return true
+	}
+
+	code := opts.Code(secret, now)
+
+	if !accept(code, now) {
+		t.Fatal("first use of the code rejected")
+	}
+
+	if accept(code, now) {
+		t.Error("replayed code accepted")
+	}
+
+	if accept(code, now.Add(30*time.Second)) {
+		t.Error("replayed code accepted in the next period")
+	}
+
+	if accept(opts.Code(secret, now.Add(-30*time.Second)), now) {
+		t.Error("code of the previous period accepted after the current one")
+	}
+
+	if !accept(opts.Code(secret, now.Add(30*time.Second)), now.Add(30*time.Second)) {
+		t.Error("code of the next period rejected")
+	}
+}
@@ -0,0 +1,213 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OTLP status codes.
+const (
+	statusCodeUnset = 0
+	statusCodeError = 2
+)
+
+// otlpAttribute, otlpSpan and friends mirror the OTLP/HTTP JSON encoding of the
+// ExportTraceServiceRequest message.
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // int64 values are encoded as strings in JSON
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func newOTLPAttribute(key string, value interface{}) otlpAttribute {
+	attr := otlpAttribute{Key: key}
+
+	switch v := value.(type) {
+	case bool:
+		attr.Value.BoolValue = &v
+	case int:
+		s := strconv.FormatInt(int64(v), 10)
+		attr.Value.IntValue = &s
+	case int32:
+		s := strconv.FormatInt(int64(v), 10)
+		attr.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		attr.Value.IntValue = &s
+	case float64:
+		attr.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		attr.Value.StringValue = &s
+	}
+
+	return attr
+}
+
+// toOTLP converts a span to its OTLP JSON representation. The attributes are sorted by key so
+// that the output is deterministic.
+func (s *Span) toOTLP() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := otlpSpan{
+		TraceID:           s.context.TraceID.String(),
+		SpanID:            s.context.SpanID.String(),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Status:            otlpStatus{Code: statusCodeUnset},
+	}
+
+	if s.parentSpanID.IsValid() {
+		out.ParentSpanID = s.parentSpanID.String()
+	}
+
+	keys := make([]string, 0, len(s.attributes))
+	for key := range s.attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		out.Attributes = append(out.Attributes, newOTLPAttribute(key, s.attributes[key]))
+	}
+
+	if s.errMessage != "" {
+		out.Status = otlpStatus{Code: statusCodeError, Message: s.errMessage}
+	}
+
+	return out
+}
+
+// WriterExporter struct writes every span as a line of JSON, in the OTLP span format, to an
+// io.Writer. It is meant for local testing, e.g. with os.Stdout.
+type WriterExporter struct {
+	out io.Writer
+	mu  sync.Mutex
+}
+
+// NewWriterExporter function returns a new WriterExporter writing to out.
+func NewWriterExporter(out io.Writer) *WriterExporter {
+	return &WriterExporter{out: out}
+}
+
+func (e *WriterExporter) Export(ctx context.Context, spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	enc := json.NewEncoder(e.out)
+
+	for _, span := range spans {
+		err := enc.Encode(span.toOTLP())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// OTLPExporter struct sends the spans to an OpenTelemetry collector using the OTLP/HTTP
+// protocol with the JSON encoding.
+type OTLPExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+}
+
+// NewOTLPExporter function returns a new OTLPExporter sending to endpoint, which is the full
+// URL of the traces endpoint, e.g. http://localhost:4318/v1/traces.
+func NewOTLPExporter(endpoint, serviceName string) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *OTLPExporter) Export(ctx context.Context, spans []*Span) error {
+	otlpSpans := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		otlpSpans[i] = span.toOTLP()
+	}
+
+	type scopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+
+	type resourceSpans struct {
+		Resource struct {
+			Attributes []otlpAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+
+	var rs resourceSpans
+	rs.Resource.Attributes = []otlpAttribute{newOTLPAttribute("service.name", e.serviceName)}
+
+	ss := scopeSpans{Spans: otlpSpans}
+	ss.Scope.Name = "github.com/luca0x333/go-greenlight/internal/tracing"
+	rs.ScopeSpans = []scopeSpans{ss}
+
+	body, err := json.Marshal(map[string]interface{}{"resourceSpans": []resourceSpans{rs}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// Drain the body so that the connection can be reused.
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("otlp exporter: unexpected status %s", res.Status)
+	}
+
+	return nil
+}
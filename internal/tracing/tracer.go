@@ -0,0 +1,128 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Exporter interface is implemented by the span exporters (stdout, OTLP).
+type Exporter interface {
+	Export(ctx context.Context, spans []*Span) error
+}
+
+// Tracer struct batches the ended spans and exports them in a background goroutine, so that
+// the requests never wait on the collector. Spans are dropped if the queue is full.
+type Tracer struct {
+	exporter      Exporter
+	queue         chan *Span
+	batchSize     int
+	flushInterval time.Duration
+	onError       func(error)
+	stop          chan struct{}
+	done          chan struct{}
+	stopOnce      sync.Once
+}
+
+// New function returns a Tracer exporting spans to exporter and starts its background
+// goroutine. onError is called (from the background goroutine) when an export fails.
+func New(exporter Exporter, onError func(error)) *Tracer {
+	t := &Tracer{
+		exporter:      exporter,
+		queue:         make(chan *Span, 2048),
+		batchSize:     512,
+		flushInterval: 5 * time.Second,
+		onError:       onError,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+	go t.run()
+
+	return t
+}
+
+// enqueue queues the ended span for export. The queue is never closed, as the spans started
+// before Shutdown() can end at any time after it: they are dropped once the tracer is stopped.
+func (t *Tracer) enqueue(span *Span) {
+	select {
+	case <-t.stop:
+		return
+	default:
+	}
+
+	select {
+	case t.queue <- span:
+	default:
+		// The queue is full, drop the span rather than blocking the request.
+	}
+}
+
+// run exports the spans in batches of batchSize, or every flushInterval, until the tracer is
+// stopped. It then exports the spans left in the queue.
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, t.batchSize)
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		err := t.exporter.Export(ctx, batch)
+		if err != nil && t.onError != nil {
+			t.onError(err)
+		}
+
+		batch = make([]*Span, 0, t.batchSize)
+	}
+
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= t.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.stop:
+			for {
+				select {
+				case span := <-t.queue:
+					batch = append(batch, span)
+					if len(batch) >= t.batchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Shutdown exports the queued spans and stops the background goroutine. Spans ended after
+// Shutdown() has been called are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.stopOnce.Do(func() {
+		// No new spans are started, and those already started are dropped when they end.
+		SetTracer(nil)
+		close(t.stop)
+	})
+
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,191 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SpanKind custom type describes the relationship between the span, its parent and its children,
+// using the same values as the OpenTelemetry protocol.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// TraceID and SpanID are the W3C trace context identifiers.
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// IsValid returns true if the identifier is not all zeroes.
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+func (s SpanID) IsValid() bool  { return s != SpanID{} }
+
+// SpanContext struct holds the identifiers which are propagated across process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+	Remote  bool
+}
+
+// IsValid returns true if both the trace and span identifiers are valid.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Span struct records a timed operation. All the methods can safely be called on a nil *Span,
+// which is what Start() returns when tracing is disabled or the trace isn't sampled.
+type Span struct {
+	tracer       *Tracer
+	name         string
+	kind         SpanKind
+	context      SpanContext
+	parentSpanID SpanID
+	start        time.Time
+	end          time.Time
+	attributes   map[string]interface{}
+	errMessage   string
+	mu           sync.Mutex
+	ended        int32
+}
+
+// SpanContext returns the identifiers of the span.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+
+	return s.context
+}
+
+// SetName overrides the name given to the span when it was started.
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+// SetAttribute records a key/value pair on the span. value should be a string, a bool, an
+// integer or a float, anything else is recorded using its fmt representation.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	switch value.(type) {
+	case string, bool, int, int32, int64, float64:
+	default:
+		value = fmt.Sprint(value)
+	}
+
+	s.mu.Lock()
+	s.attributes[key] = value
+	s.mu.Unlock()
+}
+
+// RecordError marks the span as failed with the error message. A nil err is ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.errMessage = err.Error()
+	s.mu.Unlock()
+}
+
+// End records the end time of the span and hands it to the tracer exporter.
+// Only the first call has an effect.
+func (s *Span) End() {
+	if s == nil || !atomic.CompareAndSwapInt32(&s.ended, 0, 1) {
+		return
+	}
+
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	s.tracer.enqueue(s)
+}
+
+// spanContextKey is the context key of the current span (or remote span context).
+type spanContextKey struct{}
+
+// ContextWithSpan returns a copy of ctx holding span as the current span.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, span.SpanContext())
+}
+
+// ContextWithRemoteSpanContext returns a copy of ctx holding a span context received from
+// another process, which the next span started from ctx will use as parent.
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	sc.Remote = true
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context of the current span, if any.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc
+}
+
+// global is the tracer used by Start(). A nil tracer disables tracing.
+var global atomic.Value
+
+// SetTracer sets the tracer used by Start().
+func SetTracer(t *Tracer) {
+	global.Store(t)
+}
+
+// Start starts a new span as a child of the current span in ctx (or as the root of a new trace)
+// and returns a copy of ctx holding it. When tracing is disabled, or the parent trace isn't
+// sampled, ctx is returned unchanged with a nil span.
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	t, _ := global.Load().(*Tracer)
+	if t == nil {
+		return ctx, nil
+	}
+
+	parent := SpanContextFromContext(ctx)
+
+	span := &Span{
+		tracer:     t,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+
+	if parent.IsValid() {
+		if !parent.Sampled {
+			return ctx, nil
+		}
+
+		span.context.TraceID = parent.TraceID
+		span.parentSpanID = parent.SpanID
+	} else {
+		rand.Read(span.context.TraceID[:])
+	}
+
+	rand.Read(span.context.SpanID[:])
+	span.context.Sampled = true
+
+	return ContextWithSpan(ctx, span), span
+}
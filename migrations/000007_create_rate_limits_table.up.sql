@@ -0,0 +1,8 @@
+CREATE UNLOGGED TABLE IF NOT EXISTS rate_limits (
+    key text PRIMARY KEY,
+    tat timestamp(6) with time zone NOT NULL,
+    rate double precision NOT NULL,
+    burst integer NOT NULL,
+    last_seen timestamp(6) with time zone NOT NULL,
+    rejected bigint NOT NULL DEFAULT 0
+);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS login_attempts (
+    kind text NOT NULL,
+    key text NOT NULL,
+    failures integer NOT NULL,
+    last_failure_at timestamp(6) with time zone NOT NULL,
+    locked_until timestamp(6) with time zone,
+    PRIMARY KEY (kind, key)
+);
+
+CREATE INDEX IF NOT EXISTS login_attempts_last_failure_at_idx ON login_attempts (last_failure_at);
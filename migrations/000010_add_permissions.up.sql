@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS permissions (
+    id bigserial PRIMARY KEY,
+    code text NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS users_permissions (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (user_id, permission_id)
+);
+
+INSERT INTO permissions (code)
+VALUES
+    ('movies:read'),
+    ('movies:write')
+ON CONFLICT DO NOTHING;
+
+-- The existing users keep reading and writing the movies, which was allowed to everyone. The
+-- new users only get movies:read, movies:write is granted by an operator.
+INSERT INTO users_permissions
+SELECT users.id, permissions.id FROM users, permissions
+WHERE permissions.code IN ('movies:read', 'movies:write')
+ON CONFLICT DO NOTHING;
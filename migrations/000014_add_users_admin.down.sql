@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS admin_actions;
+
+UPDATE users SET activated = email_verified;
+
+ALTER TABLE users DROP COLUMN IF EXISTS email_verified;
+
+DELETE FROM permissions WHERE code = 'users:admin';
@@ -0,0 +1,22 @@
+-- The user administrators are granted users:admin by an operator.
+INSERT INTO permissions (code)
+VALUES ('users:admin')
+ON CONFLICT DO NOTHING;
+
+-- activated was only set once the email address of a user was verified by an OIDC login, it is
+-- now set by the administrators and the deactivated users can't log in.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified bool NOT NULL DEFAULT false;
+
+UPDATE users SET email_verified = activated, activated = true;
+
+-- The target user isn't a foreign key, so that the actions on a deleted user are kept.
+CREATE TABLE IF NOT EXISTS admin_actions (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    actor_id bigint REFERENCES users ON DELETE SET NULL,
+    user_id bigint NOT NULL,
+    action text NOT NULL,
+    details jsonb NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX IF NOT EXISTS admin_actions_user_id_idx ON admin_actions (user_id);